@@ -0,0 +1,67 @@
+package aws
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceAwsVolumeAttachment() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceAwsVolumeAttachmentRead,
+
+		Schema: map[string]*schema.Schema{
+			"volume_id": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"instance_id": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"device_name": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"attach_time": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"state": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceAwsVolumeAttachmentRead(d *schema.ResourceData, meta interface{}) error {
+	conn := newInstrumentedEC2Conn(meta.(*AWSClient))
+	vID := d.Get("volume_id").(string)
+	iID := d.Get("instance_id").(string)
+
+	// The attachment's ID depends on its device, which isn't known yet
+	res, state, err := volumeAttachmentStateRefreshFunc(conn, fmt.Sprintf("%s:%s", vID, iID), vID, iID, "")()
+	if err != nil {
+		return fmt.Errorf("Error reading Volume (%s) attachment to Instance (%s): %s", vID, iID, err)
+	}
+
+	attachment := res.(*ec2.VolumeAttachment)
+	if attachment == nil {
+		return fmt.Errorf("Volume (%s) is not attached to Instance (%s)", vID, iID)
+	}
+
+	log.Printf("[DEBUG] aws_volume_attachment - Volume (%s) is %s to Instance (%s) as %s",
+		vID, state, iID, *attachment.Device)
+	d.SetId(volumeAttachmentID(*attachment.Device, vID, iID))
+	d.Set("device_name", attachment.Device)
+	d.Set("state", attachment.State)
+	if attachment.AttachTime != nil {
+		d.Set("attach_time", attachment.AttachTime.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestAccAWSVolumeAttachmentDataSource_basic(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		PreCheck:  func() { testAccPreCheck(t) },
+		Providers: testAccProviders,
+		Steps: []resource.TestStep{
+			{
+				Config: testAccCheckAwsVolumeAttachmentDataSourceConfig,
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckAwsVolumeAttachmentDataSourceID("data.aws_volume_attachment.ebs_att"),
+					resource.TestCheckResourceAttr("data.aws_volume_attachment.ebs_att", "device_name", "/dev/sdh"),
+					resource.TestCheckResourceAttr("data.aws_volume_attachment.ebs_att", "state", "attached"),
+				),
+			},
+		},
+	})
+}
+
+func TestDataSourceAwsVolumeAttachmentRead(t *testing.T) {
+	attached := true
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		out := ec2.DescribeVolumesOutput{}
+		if attached {
+			out = testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+			out.Volumes[0].Attachments[0].Device = aws.String("/dev/sdf")
+		}
+		*r.Data.(*ec2.DescribeVolumesOutput) = out
+	})
+
+	d := dataSourceAwsVolumeAttachment().TestResourceData()
+	d.Set("volume_id", "vol-12345678")
+	d.Set("instance_id", "i-12345678")
+	if err := dataSourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Id() != volumeAttachmentID("/dev/sdf", "vol-12345678", "i-12345678") {
+		t.Fatalf("unexpected ID: %q", d.Id())
+	}
+	if v := d.Get("device_name").(string); v != "/dev/sdf" {
+		t.Fatalf("expected device_name to be /dev/sdf, got %q", v)
+	}
+	if v := d.Get("state").(string); v != "attached" {
+		t.Fatalf("expected state to be attached, got %q", v)
+	}
+
+	attached = false
+	if err := dataSourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err == nil {
+		t.Fatalf("expected error for a volume that is not attached")
+	}
+}
+
+func testAccCheckAwsVolumeAttachmentDataSourceID(n string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[n]
+		if !ok {
+			return fmt.Errorf("Can't find Volume Attachment data source: %s", n)
+		}
+
+		if rs.Primary.ID == "" {
+			return fmt.Errorf("Volume Attachment data source ID not set")
+		}
+		return nil
+	}
+}
+
+const testAccCheckAwsVolumeAttachmentDataSourceConfig = `
+resource "aws_instance" "web" {
+	ami = "ami-21f78e11"
+	availability_zone = "us-west-2a"
+	instance_type = "t1.micro"
+	tags {
+		Name = "HelloWorld"
+	}
+}
+
+resource "aws_ebs_volume" "example" {
+	availability_zone = "us-west-2a"
+	size = 1
+}
+
+resource "aws_volume_attachment" "ebs_att" {
+	device_name = "/dev/sdh"
+	volume_id = "${aws_ebs_volume.example.id}"
+	instance_id = "${aws_instance.web.id}"
+}
+
+data "aws_volume_attachment" "ebs_att" {
+	volume_id = "${aws_volume_attachment.ebs_att.volume_id}"
+	instance_id = "${aws_volume_attachment.ebs_att.instance_id}"
+}
+`
@@ -0,0 +1,95 @@
+package aws
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// instrumentedEC2Conn wraps an EC2 client so that every call the volume
+// attachment resource makes logs its latency, error code and AWS request ID at
+// TRACE level. All other calls pass straight through to the embedded client.
+type instrumentedEC2Conn struct {
+	*ec2.EC2
+}
+
+func newInstrumentedEC2Conn(client *AWSClient) *instrumentedEC2Conn {
+	return &instrumentedEC2Conn{EC2: client.ec2conn}
+}
+
+func (c *instrumentedEC2Conn) AttachVolume(input *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error) {
+	req, out := c.EC2.AttachVolumeRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) DetachVolume(input *ec2.DetachVolumeInput) (*ec2.VolumeAttachment, error) {
+	req, out := c.EC2.DetachVolumeRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) DescribeVolumes(input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+	req, out := c.EC2.DescribeVolumesRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) StopInstances(input *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
+	req, out := c.EC2.StopInstancesRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	req, out := c.EC2.DescribeInstancesRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) StartInstances(input *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	req, out := c.EC2.StartInstancesRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) DescribeVolumeStatus(input *ec2.DescribeVolumeStatusInput) (*ec2.DescribeVolumeStatusOutput, error) {
+	req, out := c.EC2.DescribeVolumeStatusRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) ModifyInstanceAttribute(input *ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error) {
+	req, out := c.EC2.ModifyInstanceAttributeRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	req, out := c.EC2.CreateTagsRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) DeleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	req, out := c.EC2.DeleteTagsRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) CreateSnapshot(input *ec2.CreateSnapshotInput) (*ec2.Snapshot, error) {
+	req, out := c.EC2.CreateSnapshotRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) DescribeSnapshots(input *ec2.DescribeSnapshotsInput) (*ec2.DescribeSnapshotsOutput, error) {
+	req, out := c.EC2.DescribeSnapshotsRequest(input)
+	return out, c.send(req)
+}
+
+func (c *instrumentedEC2Conn) send(req *request.Request) error {
+	start := time.Now()
+	err := req.Send()
+
+	errorCode := ""
+	if awsErr, ok := err.(awserr.Error); ok {
+		errorCode = awsErr.Code()
+	}
+	log.Printf("[TRACE] EC2 %s took %s (request ID: %q, error code: %q)",
+		req.Operation.Name, time.Since(start), req.RequestID, errorCode)
+
+	return err
+}
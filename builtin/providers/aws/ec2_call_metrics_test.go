@@ -0,0 +1,54 @@
+package aws
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestInstrumentedEC2Conn_logs(t *testing.T) {
+	conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		r.RequestID = "req-" + r.Operation.Name
+		if r.Operation.Name == "DetachVolume" {
+			r.Error = awserr.New("IncorrectState", "volume is not attached", nil)
+		}
+	})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := newInstrumentedEC2Conn(&AWSClient{ec2conn: conn})
+	if _, err := c.DescribeVolumes(&ec2.DescribeVolumesInput{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := c.DetachVolume(&ec2.DetachVolumeInput{VolumeId: aws.String("vol-12345678")}); err == nil {
+		t.Fatalf("expected DetachVolume error")
+	}
+	if _, err := c.StartInstances(&ec2.StartInstancesInput{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(*calls) != 3 {
+		t.Fatalf("expected every call to reach the client, got %v", *calls)
+	}
+
+	out := buf.String()
+	for _, expected := range []string{
+		`[TRACE] EC2 DescribeVolumes took `,
+		`(request ID: "req-DescribeVolumes", error code: "")`,
+		`(request ID: "req-DetachVolume", error code: "IncorrectState")`,
+		`(request ID: "req-StartInstances", error code: "")`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected log to contain %q, got %q", expected, out)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Volume attachments have no ID of their own in AWS, so they are imported
+// with an ID of the form device_name:volume_id:instance_id.
+func resourceAwsVolumeAttachmentImportState(
+	d *schema.ResourceData,
+	meta interface{}) ([]*schema.ResourceData, error) {
+	parts := strings.Split(d.Id(), ":")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf(
+			"Unexpected format of ID (%q), expected device_name:volume_id:instance_id", d.Id())
+	}
+
+	name, vID, iID := parts[0], parts[1], parts[2]
+	d.Set("device_name", name)
+	d.Set("volume_id", vID)
+	d.Set("instance_id", iID)
+	d.Set("stop_instance_before_detaching", false)
+	d.SetId(volumeAttachmentID(name, vID, iID))
+
+	if err := resourceAwsVolumeAttachmentRead(d, meta); err != nil {
+		return nil, err
+	}
+	if d.Id() == "" {
+		return nil, fmt.Errorf("Volume %s is not attached to Instance %s as %s", vID, iID, name)
+	}
+
+	return []*schema.ResourceData{d}, nil
+}
@@ -0,0 +1,59 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestResourceAwsVolumeAttachmentImportState(t *testing.T) {
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		if r.Operation.Name == "DescribeVolumes" {
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "attached")
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.SetId("/dev/sdh:vol-12345678:i-12345678")
+
+	results, err := resourceAwsVolumeAttachmentImportState(d, &AWSClient{ec2conn: conn})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+
+	expectedID := volumeAttachmentID("/dev/sdh", "vol-12345678", "i-12345678")
+	if id := results[0].Id(); id != expectedID {
+		t.Fatalf("expected ID %q, got %q", expectedID, id)
+	}
+	for k, v := range map[string]string{
+		"device_name": "/dev/sdh",
+		"volume_id":   "vol-12345678",
+		"instance_id": "i-12345678",
+	} {
+		if actual := results[0].Get(k).(string); actual != v {
+			t.Fatalf("expected %s to be %q, got %q", k, v, actual)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentImportState_badID(t *testing.T) {
+	ids := []string{
+		"vol-12345678",
+		"/dev/sdh:vol-12345678",
+		"/dev/sdh:vol-12345678:i-12345678:extra",
+		"/dev/sdh::i-12345678",
+	}
+
+	for _, id := range ids {
+		d := resourceAwsVolumeAttachment().TestResourceData()
+		d.SetId(id)
+		if _, err := resourceAwsVolumeAttachmentImportState(d, &AWSClient{}); err == nil {
+			t.Fatalf("expected error importing %q", id)
+		}
+	}
+}
@@ -162,6 +162,7 @@ func Provider() terraform.ResourceProvider {
 			"aws_s3_bucket_object":         dataSourceAwsS3BucketObject(),
 			"aws_subnet":                   dataSourceAwsSubnet(),
 			"aws_security_group":           dataSourceAwsSecurityGroup(),
+			"aws_volume_attachment":        dataSourceAwsVolumeAttachment(),
 			"aws_vpc":                      dataSourceAwsVpc(),
 		},
 
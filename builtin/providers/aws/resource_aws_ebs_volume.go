@@ -156,9 +156,15 @@ func resourceAWSEbsVolumeUpdate(d *schema.ResourceData, meta interface{}) error
 	return resourceAwsEbsVolumeRead(d, meta)
 }
 
+// volumeDescriber is implemented by both *ec2.EC2 and instrumentedEC2Conn,
+// so that volume state can be watched through either.
+type volumeDescriber interface {
+	DescribeVolumes(*ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error)
+}
+
 // volumeStateRefreshFunc returns a resource.StateRefreshFunc that is used to watch
 // a the state of a Volume. Returns successfully when volume is available
-func volumeStateRefreshFunc(conn *ec2.EC2, volumeID string) resource.StateRefreshFunc {
+func volumeStateRefreshFunc(conn volumeDescriber, volumeID string) resource.StateRefreshFunc {
 	return func() (interface{}, string, error) {
 		resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
 			VolumeIds: []*string{aws.String(volumeID)},
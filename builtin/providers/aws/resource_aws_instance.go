@@ -710,9 +710,15 @@ func resourceAwsInstanceDelete(d *schema.ResourceData, meta interface{}) error {
 	return nil
 }
 
+// instanceDescriber is implemented by both *ec2.EC2 and instrumentedEC2Conn,
+// so that instance state can be watched through either.
+type instanceDescriber interface {
+	DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+}
+
 // InstanceStateRefreshFunc returns a resource.StateRefreshFunc that is used to watch
 // an EC2 instance.
-func InstanceStateRefreshFunc(conn *ec2.EC2, instanceID string) resource.StateRefreshFunc {
+func InstanceStateRefreshFunc(conn instanceDescriber, instanceID string) resource.StateRefreshFunc {
 	return func() (interface{}, string, error) {
 		resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
 			InstanceIds: []*string{aws.String(instanceID)},
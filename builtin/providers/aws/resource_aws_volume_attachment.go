@@ -4,253 +4,3058 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/helper/hashcode"
 	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/helper/schema"
 )
 
+// These control how often the attachment waiters poll EC2 when poll_interval
+// is not set. They are variables rather than constants so unit tests can run
+// without the delays.
+var (
+	volumeAttachmentWaitDelay      = 10 * time.Second
+	volumeAttachmentWaitMinTimeout = 3 * time.Second
+)
+
+// volumeAttachmentSleep is used for pre_detach_grace_seconds, so that unit
+// tests can check the grace period without waiting it out.
+var volumeAttachmentSleep = time.Sleep
+
 func resourceAwsVolumeAttachment() *schema.Resource {
 	return &schema.Resource{
 		Create: resourceAwsVolumeAttachmentCreate,
 		Read:   resourceAwsVolumeAttachmentRead,
+		Update: resourceAwsVolumeAttachmentUpdate,
 		Delete: resourceAwsVolumeAttachmentDelete,
+		Importer: &schema.ResourceImporter{
+			State: resourceAwsVolumeAttachmentImportState,
+		},
+
+		SchemaVersion: 3,
+		MigrateState:  resourceAwsVolumeAttachmentMigrateState,
+
+		Schema: map[string]*schema.Schema{
+			"device_name": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ValidateFunc:  validateVolumeAttachmentDeviceName,
+				ConflictsWith: []string{"attachments"},
+			},
+
+			"instance_id": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"instance_tag_name"},
+			},
+
+			"instance_tag_name": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"instance_id"},
+			},
+
+			"volume_id": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"volume_tag_name", "attachments"},
+			},
+
+			"volume_tag_name": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"volume_id", "attachments"},
+			},
+
+			"region": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if err := (&Config{Region: v.(string)}).ValidateRegion(); err != nil {
+						errors = append(errors, fmt.Errorf("%q: %s", k, err))
+					}
+					return
+				},
+			},
+
+			"attachments": {
+				Type:          schema.TypeSet,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"device_name", "volume_id", "volume_tag_name"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"device_name": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validateVolumeAttachmentDeviceName,
+						},
+						"volume_id": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+					},
+				},
+			},
+
+			"force_detach": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Computed:    true,
+				Description: "Force the volume to detach. Unmount it first, as data not yet flushed to it can be lost",
+			},
+			"pre_detach_grace_seconds": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if v.(int) < 0 {
+						errors = append(errors, fmt.Errorf("%q must not be negative", k))
+					}
+					return
+				},
+			},
+
+			"force_detach_after": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					duration, err := time.ParseDuration(v.(string))
+					if err != nil {
+						errors = append(errors, fmt.Errorf(
+							"%q cannot be parsed as a duration: %s", k, err))
+					} else if duration <= 0 {
+						errors = append(errors, fmt.Errorf(
+							"%q must be positive", k))
+					}
+					return
+				},
+			},
+			"skip_destroy": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Computed: true,
+			},
+
+			"stop_instance_before_detaching": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"wait_for_instance_running": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+
+			"manage_instance_power": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+
+			"snapshot_before_detach": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"snapshot_wait_state": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "pending",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+					if value != "pending" && value != "completed" {
+						errors = append(errors, fmt.Errorf(
+							"%q must be one of \"pending\" or \"completed\"", k))
+					}
+					return
+				},
+			},
+
+			"snapshot_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "10m",
+				ValidateFunc: validateVolumeAttachmentDuration,
+			},
+
+			"last_attachment_behavior": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "ignore",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+					if value != "wait" && value != "error" && value != "ignore" {
+						errors = append(errors, fmt.Errorf(
+							"%q must be one of \"wait\", \"error\" or \"ignore\"", k))
+					}
+					return
+				},
+			},
+
+			"detach_timeout_behavior": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "error",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+					if value != "error" && value != "continue" {
+						errors = append(errors, fmt.Errorf(
+							"%q must be one of \"error\" or \"continue\"", k))
+					}
+					return
+				},
+			},
+
+			"stop_autoscaling_instances": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"wait_for_snapshot_init": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"start_instance_after_attach": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"error_if_stop_required": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"wait_for_attachment_cleanup": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"wait_for_device_release": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"wait_for_available": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"verify_ebs_optimized": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"manage_lifecycle_only": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"delete_on_termination": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Computed: true,
+			},
+
+			"dry_run": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"poll_interval": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					duration, err := time.ParseDuration(v.(string))
+					if err != nil {
+						errors = append(errors, fmt.Errorf(
+							"%q cannot be parsed as a duration: %s", k, err))
+					} else if duration < time.Second {
+						errors = append(errors, fmt.Errorf(
+							"%q must be at least 1s", k))
+					}
+					return
+				},
+			},
+
+			"attach_not_found_checks": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  20,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if v.(int) < 1 {
+						errors = append(errors, fmt.Errorf("%q must be at least 1", k))
+					}
+					return
+				},
+			},
+
+			"attach_confirmations": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  2,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if v.(int) < 1 {
+						errors = append(errors, fmt.Errorf("%q must be at least 1", k))
+					}
+					return
+				},
+			},
+
+			"stop_wait_max_attempts": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if v.(int) < 1 {
+						errors = append(errors, fmt.Errorf("%q must be at least 1", k))
+					}
+					return
+				},
+			},
+
+			"tags": tagsSchema(),
+
+			"timeouts": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"create": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validateVolumeAttachmentDuration,
+						},
+						"delete": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validateVolumeAttachmentDuration,
+						},
+					},
+				},
+			},
+
+			"attach_time": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"attachment_state": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"instance_state": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"volume_attachment_count": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"volume_arn": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"volume_size": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"volume_type": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"iops": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"encrypted": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			"kms_key_id": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"is_root_device": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			"allow_root_detach": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"will_stop_instance_on_destroy": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceAwsVolumeAttachmentCreate(d *schema.ResourceData, meta interface{}) error {
+	conn := newInstrumentedEC2Conn(volumeAttachmentAWSClient(d, meta))
+	name := d.Get("device_name").(string)
+	iID := d.Get("instance_id").(string)
+	vID := d.Get("volume_id").(string)
+
+	if iID == "" {
+		tagName := d.Get("instance_tag_name").(string)
+		if tagName == "" {
+			return fmt.Errorf("One of instance_id or instance_tag_name must be set")
+		}
+
+		var err error
+		iID, err = volumeAttachmentInstanceIDByName(conn, tagName)
+		if err != nil {
+			return err
+		}
+		d.Set("instance_id", iID)
+	}
+	if _, ok := d.GetOk("attachments"); ok {
+		return resourceAwsVolumeAttachmentBatchCreate(d, meta, iID)
+	}
+	if name == "" {
+		return fmt.Errorf("One of device_name or attachments must be set")
+	}
+	if vID == "" {
+		tagName := d.Get("volume_tag_name").(string)
+		if tagName == "" {
+			return fmt.Errorf("One of volume_id or volume_tag_name must be set")
+		}
+
+		var err error
+		vID, err = volumeAttachmentVolumeIDByName(conn, tagName)
+		if err != nil {
+			return err
+		}
+		d.Set("volume_id", vID)
+	}
+	id := volumeAttachmentID(name, vID, iID)
+
+	dryRun := d.Get("dry_run").(bool)
+
+	for _, call := range volumeAttachmentPlannedCalls(d, false) {
+		volumeAttachmentLogf("TRACE", id, "create will call %s", call)
+	}
+
+	if d.Get("verify_ebs_optimized").(bool) {
+		if err := verifyVolumeAttachmentEbsOptimized(conn, id, vID, iID); err != nil {
+			return err
+		}
+	}
+
+	createTimeout, err := volumeAttachmentTimeout(d, "create", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
+	}
+
+	if err := volumeAttachmentDevices.claim(iID, name, vID); err != nil {
+		return err
+	}
+
+	attach := true
+	if d.Get("manage_lifecycle_only").(bool) {
+		// Adopt an existing attachment rather than failing on it
+		_, state, err := volumeAttachmentStateRefreshFunc(conn, id, vID, iID, name)()
+		if err != nil {
+			volumeAttachmentDevices.release(iID, name, vID)
+			return fmt.Errorf(
+				"Error reading Volume (%s) attachment to Instance (%s): %s",
+				vID, iID, err)
+		}
+		if state == "attached" || state == "attaching" {
+			volumeAttachmentLogf("DEBUG", id, "Adopting existing attachment of Volume (%s) to Instance (%s)", vID, iID)
+			attach = false
+		}
+	}
+
+	if attach {
+		attach, err = prepareVolumeAttachmentAttach(conn, d, id, name, vID, iID, dryRun, createTimeout, delay, minTimeout)
+		if err != nil {
+			volumeAttachmentDevices.release(iID, name, vID)
+			return err
+		}
+	}
+
+	// Volumes from the instance's launch-time block device mapping are
+	// always attached already, so they are only ever adopted
+	if !attach {
+		warnVolumeAttachmentLaunchMapping(conn, id, name, vID, iID)
+	}
+
+	if attach {
+		if err := attachVolumeAttachmentVolume(conn, d, id, name, vID, iID, dryRun, createTimeout, delay, minTimeout); err != nil {
+			volumeAttachmentDevices.release(iID, name, vID)
+			return err
+		}
+
+		if dryRun {
+			// Nothing was attached, so nothing is recorded in state either
+			volumeAttachmentDevices.release(iID, name, vID)
+			volumeAttachmentLogf("INFO", id, "Dry run attaching Volume (%s) to Instance (%s) succeeded, nothing was attached", vID, iID)
+			return nil
+		}
+	}
+
+	stateConf := volumeAttachmentAttachedStateConf(conn, d, id, vID, iID, name, createTimeout, delay, minTimeout)
+	_, err = waitForVolumeAttachmentState(id, stateConf, fmt.Sprintf("Volume (%s) to attach to Instance (%s)", vID, iID))
+	if err != nil {
+		volumeAttachmentDevices.release(iID, name, vID)
+		if err, ok := err.(*resource.UnexpectedStateError); ok && err.State == "gone" {
+			return fmt.Errorf("volume %s disappeared during attach to instance %s", vID, iID)
+		}
+		return fmt.Errorf(
+			"Error waiting for Volume (%s) to attach to Instance: %s, error: %s",
+			vID, iID, err)
+	}
+
+	d.SetId(id)
+
+	// An explicit false is applied too, e.g. for a volume whose flag is set
+	// in the instance's launch mappings
+	if v, ok := d.GetOkExists("delete_on_termination"); ok {
+		if err := setVolumeAttachmentDeleteOnTermination(conn, d, v.(bool)); err != nil {
+			return err
+		}
+	}
+
+	if err := setVolumeAttachmentTags(conn, id, vID, nil, d.Get("tags").(map[string]interface{})); err != nil {
+		return err
+	}
+
+	if d.Get("start_instance_after_attach").(bool) {
+		if err := startVolumeAttachmentInstanceAfterAttach(conn, d); err != nil {
+			return err
+		}
+	}
+
+	return resourceAwsVolumeAttachmentRead(d, meta)
+}
+
+// prepareVolumeAttachmentAttach gets the volume ready to be attached to the
+// instance as name and checks that it can be. It reports false if the volume
+// is already attached there, in which case there is nothing left to attach. A
+// dry run only checks the instance, as nothing is waited on.
+func prepareVolumeAttachmentAttach(conn *instrumentedEC2Conn, d *schema.ResourceData, id, name, vID, iID string, dryRun bool,
+	timeout, delay, minTimeout time.Duration) (bool, error) {
+	if !dryRun {
+		// A volume created in the same apply may still be "creating", and
+		// a re-run after a partial apply may find it already attached.
+		attached, err := waitForVolumeAttachmentVolume(conn, id, name, vID, iID, timeout, delay, minTimeout)
+		if err != nil {
+			return false, err
+		}
+		if attached {
+			volumeAttachmentLogf("DEBUG", id, "Volume (%s) is already attached to Instance (%s)", vID, iID)
+			return false, nil
+		}
+
+		if d.Get("wait_for_snapshot_init").(bool) {
+			if err := waitForVolumeAttachmentSnapshotInit(conn, id, vID, timeout, delay, minTimeout); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if err := checkVolumeAttachmentTarget(conn, id, name, vID, iID, timeout, delay, minTimeout); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// attachVolumeAttachmentVolume calls AttachVolume for the volume and instance,
+// without waiting for the attachment. A volume moved between instances in the
+// same apply can still be settling from its previous detach, and one created
+// in the same apply can briefly still be "creating", so it is retried until
+// the volume is free. The retries are jittered so that attachments created
+// together don't retry in step.
+func attachVolumeAttachmentVolume(conn *instrumentedEC2Conn, d *schema.ResourceData, id, name, vID, iID string, dryRun bool,
+	timeout, delay, minTimeout time.Duration) error {
+	opts := &ec2.AttachVolumeInput{
+		Device:     aws.String(name),
+		InstanceId: aws.String(iID),
+		VolumeId:   aws.String(vID),
+		DryRun:     aws.Bool(dryRun),
+	}
+
+	volumeAttachmentLogf("DEBUG", id, "Attaching Volume (%s) to Instance (%s) as %s", vID, iID, name)
+	err := resource.Retry(timeout, func() *resource.RetryError {
+		_, err := conn.AttachVolume(opts)
+		if awsErr, ok := err.(awserr.Error); ok {
+			if dryRun && awsErr.Code() == "DryRunOperation" {
+				return nil
+			}
+			if awsErr.Code() == "VolumeInUse" && d.Get("force_detach").(bool) && !dryRun {
+				// The volume can still be attached to an instance that has
+				// since been replaced
+				if err := forceDetachVolumeFromOtherInstances(conn, id, vID, iID, timeout, delay, minTimeout); err != nil {
+					return resource.NonRetryableError(err)
+				}
+				clearStaleVolumeAttachment(conn, id, vID, iID)
+			}
+			if awsErr.Code() == "VolumeInUse" || awsErr.Code() == "IncorrectState" {
+				volumeAttachmentLogf("DEBUG", id, "Volume (%s) is not ready to attach yet: %s", vID, err)
+				volumeAttachmentJitter(minTimeout / 2)
+				return resource.RetryableError(err)
+			}
+		}
+		if err != nil {
+			return resource.NonRetryableError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			return fmt.Errorf("[WARN] Error attaching volume (%s) to instance (%s), %s",
+				vID, iID, volumeAttachmentAWSErrorDetails(awsErr))
+		}
+		return err
+	}
+	return nil
+}
+
+// volumeAttachmentInstanceIDByName looks up the ID of the single instance
+// whose Name tag is name. Terminated instances are ignored, since they linger
+// for a while after an instance with the same name has replaced them.
+func volumeAttachmentInstanceIDByName(conn *instrumentedEC2Conn, name string) (string, error) {
+	resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String(name)},
+			},
+			&ec2.Filter{
+				Name:   aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error looking up Instance with Name tag %q: %s", name, err)
+	}
+
+	var ids []string
+	for _, r := range resp.Reservations {
+		for _, i := range r.Instances {
+			ids = append(ids, *i.InstanceId)
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("No Instance found with Name tag %q", name)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%d Instances found with Name tag %q, expected exactly one: %s",
+			len(ids), name, strings.Join(ids, ", "))
+	}
+}
+
+// volumeAttachmentVolumeIDByName looks up the ID of the single volume whose
+// Name tag is name. Volumes that are being deleted are ignored.
+func volumeAttachmentVolumeIDByName(conn *instrumentedEC2Conn, name string) (string, error) {
+	resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String(name)},
+			},
+			&ec2.Filter{
+				Name:   aws.String("status"),
+				Values: aws.StringSlice([]string{"creating", "available", "in-use"}),
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error looking up Volume with Name tag %q: %s", name, err)
+	}
+
+	var ids []string
+	for _, v := range resp.Volumes {
+		ids = append(ids, *v.VolumeId)
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("No Volume found with Name tag %q", name)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%d Volumes found with Name tag %q, expected exactly one: %s",
+			len(ids), name, strings.Join(ids, ", "))
+	}
+}
+
+// waitForVolumeAttachmentSnapshotInit waits for a volume restored from a
+// snapshot to pass its volume status checks before it is attached. Right
+// after it is created the status is "insufficient-data". EC2 does not report
+// when the snapshot's blocks have all been loaded, so this is as far as the
+// volume's readiness can be checked. Volumes not created from a snapshot are
+// not waited on.
+func waitForVolumeAttachmentSnapshotInit(conn *instrumentedEC2Conn, id, volumeID string, timeout, delay, minTimeout time.Duration) error {
+	resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading EC2 volume %s: %s", volumeID, err)
+	}
+	if len(resp.Volumes) == 0 || aws.StringValue(resp.Volumes[0].SnapshotId) == "" {
+		volumeAttachmentLogf("DEBUG", id, "Volume (%s) was not created from a snapshot, not waiting for it to initialize", volumeID)
+		return nil
+	}
+
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"insufficient-data"},
+		Target:  []string{"ok"},
+		Refresh: func() (interface{}, string, error) {
+			resp, err := conn.DescribeVolumeStatus(&ec2.DescribeVolumeStatusInput{
+				VolumeIds: []*string{aws.String(volumeID)},
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			if len(resp.VolumeStatuses) == 0 || resp.VolumeStatuses[0].VolumeStatus == nil {
+				return resp, "insufficient-data", nil
+			}
+			return resp, aws.StringValue(resp.VolumeStatuses[0].VolumeStatus.Status), nil
+		},
+		Timeout:    timeout,
+		Delay:      delay,
+		MinTimeout: minTimeout,
+	}
+	if _, err := waitForVolumeAttachmentState(id, stateConf, fmt.Sprintf("Volume (%s) restored from %s to initialize",
+		volumeID, aws.StringValue(resp.Volumes[0].SnapshotId))); err != nil {
+		return fmt.Errorf("Error waiting for Volume (%s) to initialize: %s", volumeID, err)
+	}
+	return nil
+}
+
+// checkVolumeAttachmentTarget returns an error if the volume and instance are
+// in different availability zones, or if the instance already has a different
+// volume mapped at the device name. AttachVolume would otherwise reject both
+// part way through an apply with an error that doesn't say what is wrong.
+//
+// An instance that is still booting or stopping, e.g. because it was created
+// in the same apply, is waited on until it is running or stopped, since
+// AttachVolume can fail in between.
+func checkVolumeAttachmentTarget(conn *instrumentedEC2Conn, id, name, volumeID, instanceID string, timeout, delay, minTimeout time.Duration) error {
+	resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading Instance (%s): %s", instanceID, err)
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil
+	}
+	instance := resp.Reservations[0].Instances[0]
+
+	state := ""
+	if instance.State != nil {
+		state = aws.StringValue(instance.State.Name)
+	}
+	if state == "pending" || state == "stopping" {
+		volumeAttachmentLogf("DEBUG", id, "Waiting for Instance (%s) to leave the %s state before attaching", instanceID, state)
+		stateConf := &resource.StateChangeConf{
+			Pending:    []string{"pending", "stopping"},
+			Target:     []string{"running", "stopped"},
+			Refresh:    InstanceStateRefreshFunc(conn, instanceID),
+			Timeout:    timeout,
+			Delay:      delay,
+			MinTimeout: minTimeout,
+		}
+
+		i, err := waitForVolumeAttachmentState(id, stateConf, fmt.Sprintf("Instance (%s) to leave the %s state", instanceID, state))
+		if err != nil {
+			return fmt.Errorf(
+				"Error waiting for Instance (%s) to be running or stopped: %s", instanceID, err)
+		}
+		instance = i.(*ec2.Instance)
+	}
+
+	if err := checkVolumeAttachmentPlatformDeviceName(name, instanceID, aws.StringValue(instance.Platform)); err != nil {
+		return err
+	}
+
+	vols, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading EC2 volume %s: %s", volumeID, err)
+	}
+	if len(vols.Volumes) > 0 && vols.Volumes[0].AvailabilityZone != nil &&
+		instance.Placement != nil && instance.Placement.AvailabilityZone != nil &&
+		*vols.Volumes[0].AvailabilityZone != *instance.Placement.AvailabilityZone {
+		return fmt.Errorf("volume %s is in %s but instance %s is in %s",
+			volumeID, *vols.Volumes[0].AvailabilityZone, instanceID, *instance.Placement.AvailabilityZone)
+	}
+
+	for _, bdm := range instance.BlockDeviceMappings {
+		if bdm.DeviceName == nil || bdm.Ebs == nil || bdm.Ebs.VolumeId == nil {
+			continue
+		}
+		if normalizeVolumeAttachmentDeviceName(*bdm.DeviceName) != normalizeVolumeAttachmentDeviceName(name) {
+			continue
+		}
+		if *bdm.Ebs.VolumeId != volumeID {
+			return fmt.Errorf("device %s is already in use by volume %s on instance %s",
+				name, *bdm.Ebs.VolumeId, instanceID)
+		}
+	}
+
+	logVolumeAttachmentLaunchMapping(id, instance, name, volumeID)
+
+	return nil
+}
+
+// warnVolumeAttachmentLaunchMapping reads the instance of an existing
+// attachment and warns if the volume comes from its launch-time block device
+// mapping. It is only a warning, so failing to read the instance is logged
+// and otherwise ignored.
+func warnVolumeAttachmentLaunchMapping(conn *instrumentedEC2Conn, id, name, volumeID, instanceID string) {
+	resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		volumeAttachmentLogf("DEBUG", id, "Error reading Instance (%s) to check its launch-time block device mapping: %s",
+			instanceID, err)
+		return
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return
+	}
+	logVolumeAttachmentLaunchMapping(id, resp.Reservations[0].Instances[0], name, volumeID)
+}
+
+// logVolumeAttachmentLaunchMapping warns if the instance has had volumeID
+// mapped as device name since it was launched; see
+// volumeAttachmentInLaunchMapping.
+func logVolumeAttachmentLaunchMapping(id string, instance *ec2.Instance, name, volumeID string) {
+	if volumeAttachmentInLaunchMapping(instance, name, volumeID) {
+		volumeAttachmentLogf("WARN", id, "Volume (%s) has been attached to Instance (%s) as %s since the instance was launched, "+
+			"e.g. from an ebs_block_device of its aws_instance. Managing it there and with an "+
+			"aws_volume_attachment as well causes drift; use one or the other",
+			volumeID, aws.StringValue(instance.InstanceId), name)
+	}
+}
+
+// volumeAttachmentInLaunchMapping reports whether the instance has had
+// volumeID mapped as device name since it was launched, which is how volumes
+// from its launch-time block device mappings show up. Volumes attached later
+// have an attach time after the launch time.
+func volumeAttachmentInLaunchMapping(instance *ec2.Instance, name, volumeID string) bool {
+	if instance.LaunchTime == nil {
+		return false
+	}
+	for _, bdm := range instance.BlockDeviceMappings {
+		if bdm.DeviceName == nil || bdm.Ebs == nil || bdm.Ebs.AttachTime == nil {
+			continue
+		}
+		if normalizeVolumeAttachmentDeviceName(*bdm.DeviceName) != normalizeVolumeAttachmentDeviceName(name) ||
+			aws.StringValue(bdm.Ebs.VolumeId) != volumeID {
+			continue
+		}
+		// Launch-time volumes finish attaching shortly after the launch
+		return !bdm.Ebs.AttachTime.After(instance.LaunchTime.Add(time.Minute))
+	}
+	return false
+}
+
+// waitForVolumeAttachmentVolume waits for a volume that is still being
+// created before it is attached. It reports whether the volume is already
+// attached to instanceID as device name, in which case there is nothing left
+// to attach, and returns an error if it is attached to the instance as another
+// device. A volume in use by other instances is not waited on: it may be a
+// Multi-Attach volume, and AttachVolume is retried anyway while a previous
+// detach settles.
+func waitForVolumeAttachmentVolume(conn *instrumentedEC2Conn, id, name, volumeID, instanceID string, timeout, delay, minTimeout time.Duration) (bool, error) {
+	refresh := func() (interface{}, string, error) {
+		resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if len(resp.Volumes) == 0 {
+			return resp, "missing", nil
+		}
+		if _, state := volumeAttachmentState(resp, volumeID, instanceID, name); state == "attached" || state == "attaching" {
+			return resp, "attached", nil
+		}
+		return resp, aws.StringValue(resp.Volumes[0].State), nil
+	}
+
+	resp, state, err := refresh()
+	if err != nil {
+		return false, fmt.Errorf("Error reading EC2 volume %s: %s", volumeID, err)
+	}
+
+	if state == "attached" {
+		a, _ := volumeAttachmentState(resp.(*ec2.DescribeVolumesOutput), volumeID, instanceID, name)
+		if a.Device != nil && normalizeVolumeAttachmentDeviceName(*a.Device) != normalizeVolumeAttachmentDeviceName(name) {
+			return false, fmt.Errorf("Volume (%s) is already attached to Instance (%s) as %s rather than %s",
+				volumeID, instanceID, *a.Device, name)
+		}
+	}
+
+	if state == "creating" {
+		volumeAttachmentLogf("DEBUG", id, "Waiting for Volume (%s) to become available", volumeID)
+		stateConf := &resource.StateChangeConf{
+			Pending:    []string{"creating"},
+			Target:     []string{"available", "in-use", "attached", "missing"},
+			Refresh:    refresh,
+			Timeout:    timeout,
+			Delay:      delay,
+			MinTimeout: minTimeout,
+		}
+
+		// A volume that was still being created cannot be attached yet
+		if _, err := waitForVolumeAttachmentState(id, stateConf, fmt.Sprintf("Volume (%s) to become available", volumeID)); err != nil {
+			return false, fmt.Errorf(
+				"Error waiting for Volume (%s) to become available: %s", volumeID, err)
+		}
+		return false, nil
+	}
+
+	return state == "attached", nil
+}
+
+// verifyVolumeAttachmentEbsOptimized logs a warning when a volume with
+// provisioned performance (io1, st1) is attached to an instance that is not
+// EBS-optimized, since the instance's shared network link will then cap the
+// volume well below what was provisioned.
+func verifyVolumeAttachmentEbsOptimized(conn *instrumentedEC2Conn, id, volumeID, instanceID string) error {
+	vols, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading EC2 volume %s: %s", volumeID, err)
+	}
+	if len(vols.Volumes) == 0 {
+		return nil
+	}
+	v := vols.Volumes[0]
+	if v.VolumeType == nil || (*v.VolumeType != "io1" && *v.VolumeType != "st1") {
+		return nil
+	}
+
+	resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading EC2 instance %s: %s", instanceID, err)
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil
+	}
+	i := resp.Reservations[0].Instances[0]
+
+	if i.EbsOptimized == nil || !*i.EbsOptimized {
+		volumeAttachmentLogf("WARN", id, "Volume (%s) is a %s volume but Instance (%s, %s) is not EBS-optimized; "+
+			"the volume's provisioned performance will be limited by the instance",
+			volumeID, *v.VolumeType, instanceID, aws.StringValue(i.InstanceType))
+	}
+	return nil
+}
+
+// volumeAttachmentStateRefreshFunc reports the state of the volume's
+// attachment to instanceID, preferring the one on device as described for
+// volumeAttachmentState. A volume that no longer exists is reported as
+// "gone", which detach waits accept and attach waits fail on.
+func volumeAttachmentStateRefreshFunc(conn *instrumentedEC2Conn, id, volumeID, instanceID, device string) resource.StateRefreshFunc {
+	// The last state seen is reported again when DescribeVolumes is throttled
+	// part way through a wait, so that WaitForState backs off and polls again
+	// rather than giving up.
+	var lastAttachment *ec2.VolumeAttachment
+	var lastState string
+
+	return func() (interface{}, string, error) {
+
+		request := &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+			Filters: []*ec2.Filter{
+				&ec2.Filter{
+					Name:   aws.String("attachment.instance-id"),
+					Values: []*string{aws.String(instanceID)},
+				},
+			},
+		}
+
+		resp, err := conn.DescribeVolumes(request)
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok {
+				throttled := awsErr.Code() == "RequestLimitExceeded" || awsErr.Code() == "Throttling"
+				if throttled && lastState != "" {
+					volumeAttachmentLogf("DEBUG", id, "DescribeVolumes for Volume (%s) was throttled, still %s", volumeID, lastState)
+					return lastAttachment, lastState, nil
+				}
+				if awsErr.Code() == "InvalidVolume.NotFound" {
+					lastAttachment, lastState = nil, "gone"
+					return lastAttachment, lastState, nil
+				}
+				return nil, "failed", fmt.Errorf("code: %s, message: %s", awsErr.Code(), awsErr.Message())
+			}
+			return nil, "failed", err
+		}
+
+		lastAttachment, lastState = volumeAttachmentState(resp, volumeID, instanceID, device)
+		return lastAttachment, lastState, nil
+	}
+}
+
+// volumeAttachmentNotFoundRefreshFunc wraps refresh so that an attachment
+// that isn't visible yet is reported as not found. While waiting for a new
+// attachment, DescribeVolumes can briefly return nothing at all; this lets
+// the NotFoundChecks of the wait bound how many such empty reads in a row are
+// retried before the attachment is taken to have failed.
+func volumeAttachmentNotFoundRefreshFunc(refresh resource.StateRefreshFunc) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		a, state, err := refresh()
+		if err == nil && state == "missing" {
+			return nil, "", nil
+		}
+		return a, state, err
+	}
+}
+
+// volumeAttachmentState finds the attachment of volumeID to instanceID in a
+// DescribeVolumes response filtered on that instance. Only the volume with a
+// matching ID is looked at, so a looser filter can never report the
+// attachment state of another volume. The attachment is always returned as a
+// typed *ec2.VolumeAttachment, nil when there is none, so that WaitForState
+// acts on the state reported rather than treating it as not found.
+//
+// If the volume is listed on more than one device of the instance, e.g. while
+// it is moved from one device to another, the attachment on device is
+// preferred. An attachment on another device is still returned so that a
+// device changed outside of Terraform can be detected; device may be empty
+// when any device will do.
+func volumeAttachmentState(resp *ec2.DescribeVolumesOutput, volumeID, instanceID, device string) (*ec2.VolumeAttachment, string) {
+	var volume *ec2.Volume
+	for _, v := range resp.Volumes {
+		if v.VolumeId != nil && *v.VolumeId == volumeID {
+			volume = v
+			break
+		}
+	}
+
+	// Filtering on the instance means no volume is returned at all until an
+	// attachment to it is visible, or once one is gone.
+	if volume == nil {
+		return nil, "missing"
+	}
+
+	var match *ec2.VolumeAttachment
+	for _, a := range volume.Attachments {
+		if a.InstanceId == nil || *a.InstanceId != instanceID {
+			continue
+		}
+		if device == "" || (a.Device != nil &&
+			normalizeVolumeAttachmentDeviceName(*a.Device) == normalizeVolumeAttachmentDeviceName(device)) {
+			return a, *a.State
+		}
+		if match == nil {
+			match = a
+		}
+	}
+	if match != nil {
+		return match, *match.State
+	}
+	return nil, "detached"
+}
+
+func resourceAwsVolumeAttachmentRead(d *schema.ResourceData, meta interface{}) error {
+	if _, ok := d.GetOk("attachments"); ok {
+		return resourceAwsVolumeAttachmentBatchRead(d, meta)
+	}
+
+	client := volumeAttachmentAWSClient(d, meta)
+	conn := newInstrumentedEC2Conn(client)
+
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(d.Get("volume_id").(string))},
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("attachment.instance-id"),
+				Values: []*string{aws.String(d.Get("instance_id").(string))},
+			},
+		},
+	}
+
+	vols, err := conn.DescribeVolumes(request)
+	if err != nil {
+		// Deleting either the volume or the instance removes the attachment
+		if ec2err, ok := err.(awserr.Error); ok &&
+			(ec2err.Code() == "InvalidVolume.NotFound" || ec2err.Code() == "InvalidInstanceID.NotFound") {
+			volumeAttachmentLogf("DEBUG", d.Id(), "not found (%s), removing from state", ec2err.Code())
+			d.SetId("")
+			return nil
+		}
+		return fmt.Errorf("Error reading EC2 volume %s for instance: %s: %#v", d.Get("volume_id").(string), d.Get("instance_id").(string), err)
+	}
+
+	// A volume shared from another account, e.g. through Resource Access
+	// Manager, may come back without its attachment details, so that the
+	// instance filter matches nothing.
+	if len(vols.Volumes) == 0 && volumeAttachmentSharedVolumeInUse(conn, d) {
+		return nil
+	}
+
+	// A volume is only "available" once it has no attachments at all. A
+	// Multi-Attach volume stays "in-use" while attached to other instances,
+	// so the attachment to this instance is looked for explicitly below.
+	if len(vols.Volumes) == 0 || *vols.Volumes[0].State == "available" {
+		if len(vols.Volumes) > 0 {
+			logStaleVolumeAttachment(d, vols.Volumes[0])
+		}
+		volumeAttachmentLogf("DEBUG", d.Id(), "not found, removing from state")
+		d.SetId("")
+		return nil
+	}
+
+	attachment, _ := volumeAttachmentState(vols, d.Get("volume_id").(string), d.Get("instance_id").(string), d.Get("device_name").(string))
+	if attachment == nil {
+		volumeAttachmentLogf("DEBUG", d.Id(), "not found, removing from state")
+		d.SetId("")
+		return nil
+	}
+
+	// A terminated instance can still show the volume as attached for a while
+	// before it is released, so don't wait for the attachment to disappear.
+	instance, instanceState, err := InstanceStateRefreshFunc(conn, *attachment.InstanceId)()
+	if err != nil {
+		return fmt.Errorf("Error reading EC2 instance %s: %s", *attachment.InstanceId, err)
+	}
+	if instanceState == "terminated" || instanceState == "shutting-down" {
+		volumeAttachmentLogf("WARN", d.Id(), "Instance (%s) is %s, removing from state",
+			*attachment.InstanceId, instanceState)
+		d.SetId("")
+		return nil
+	}
+
+	// The ID is derived from the device name the attachment was created with.
+	// It is deliberately left alone when the volume has since been attached
+	// to the instance on another device, so that the attachment is still
+	// tracked and the change to device_name shows up in the plan.
+	//
+	// On Nitro instances the configured name is kept for stability. EC2
+	// still reports the requested /dev/sd* name there, but the OS sees an
+	// NVMe device whose name has nothing to do with it, so a different
+	// reported name says nothing about where the volume is.
+	name := d.Get("device_name").(string)
+	i, _ := instance.(*ec2.Instance)
+	if i != nil && name != "" && volumeAttachmentIsNitroInstance(i) {
+		if name != *attachment.Device {
+			volumeAttachmentLogf("DEBUG", d.Id(), "Nitro Instance (%s) reports device %s, keeping %s",
+				*attachment.InstanceId, *attachment.Device, name)
+		}
+	} else {
+		if name != "" && name != *attachment.Device {
+			volumeAttachmentLogf("INFO", d.Id(), "device changed from %s to %s", name, *attachment.Device)
+		}
+		d.Set("device_name", attachment.Device)
+	}
+	d.Set("instance_id", attachment.InstanceId)
+	d.Set("volume_id", attachment.VolumeId)
+	d.Set("is_root_device", i != nil && i.RootDeviceName != nil && attachment.Device != nil &&
+		normalizeVolumeAttachmentDeviceName(*i.RootDeviceName) == normalizeVolumeAttachmentDeviceName(*attachment.Device))
+	d.Set("attachment_state", attachment.State)
+	d.Set("instance_state", instanceState)
+	d.Set("delete_on_termination", attachment.DeleteOnTermination)
+	if attachment.AttachTime != nil {
+		d.Set("attach_time", attachment.AttachTime.Format(time.RFC3339))
+	}
+	d.Set("volume_attachment_count", len(vols.Volumes[0].Attachments))
+	d.Set("volume_size", vols.Volumes[0].Size)
+	d.Set("volume_type", vols.Volumes[0].VolumeType)
+	d.Set("iops", aws.Int64Value(vols.Volumes[0].Iops))
+	d.Set("encrypted", aws.BoolValue(vols.Volumes[0].Encrypted))
+	d.Set("kms_key_id", aws.StringValue(vols.Volumes[0].KmsKeyId))
+
+	// Only the tags this attachment manages are read back; the volume's
+	// other tags may well be managed by its aws_ebs_volume.
+	volumeTags := tagsToMap(vols.Volumes[0].Tags)
+	tags := make(map[string]string)
+	for k := range d.Get("tags").(map[string]interface{}) {
+		if v, ok := volumeTags[k]; ok {
+			tags[k] = v
+		}
+	}
+	d.Set("tags", tags)
+
+	if arn, err := buildEBSVolumeARN(*vols.Volumes[0].VolumeId, client.partition, client.accountid, client.region); err == nil {
+		d.Set("volume_arn", arn)
+	} else {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Not setting volume_arn: %s", err)
+	}
+
+	// These only change how Terraform manages the attachment, so there is
+	// nothing to read from AWS; persist the configured values so that state
+	// written by an import or an older version does not leave them unset.
+	d.Set("force_detach", d.Get("force_detach").(bool))
+	d.Set("skip_destroy", d.Get("skip_destroy").(bool))
+
+	// Mirror Delete, which only looks at the instance once the settings say
+	// it should be stopped. Failing to check is left for the destroy to
+	// report, so the attribute errs on the side of the instance stopping.
+	willStop := volumeAttachmentStopsInstanceOnDestroy(d)
+	if willStop && i != nil {
+		reason, err := volumeAttachmentInstanceStopSkipReason(client.autoscalingconn, d, instance, instanceState)
+		if err != nil {
+			volumeAttachmentLogf("WARN", d.Id(), "%s", err)
+		} else if reason != "" {
+			volumeAttachmentLogf("DEBUG", d.Id(), "destroy would not stop Instance (%s): %s", *attachment.InstanceId, reason)
+			willStop = false
+		}
+	}
+	d.Set("will_stop_instance_on_destroy", willStop)
+
+	for _, call := range volumeAttachmentPlannedCalls(d, true) {
+		volumeAttachmentLogf("TRACE", d.Id(), "destroy would call %s", call)
+	}
+
+	return nil
+}
+
+// volumeAttachmentSharedVolumeInUse describes the attachment's volume by ID
+// alone and reports whether it is "in-use" without listing any attachments,
+// in which case the attachment is trusted to still exist even though AWS
+// didn't say which instance the volume is attached to. A volume that lists
+// attachments, none of them to this instance, has moved elsewhere.
+func volumeAttachmentSharedVolumeInUse(conn *instrumentedEC2Conn, d *schema.ResourceData) bool {
+	vID := d.Get("volume_id").(string)
+	resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(vID)},
+	})
+	if err != nil {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Error describing Volume (%s) without the instance filter: %s", vID, err)
+		return false
+	}
+	if len(resp.Volumes) == 0 || aws.StringValue(resp.Volumes[0].State) != "in-use" {
+		return false
+	}
+	if len(resp.Volumes[0].Attachments) > 0 {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) is attached to other instances than Instance (%s)",
+			vID, d.Get("instance_id").(string))
+		return false
+	}
+
+	volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) is in-use but lists no attachments; "+
+		"it may be shared from another account, keeping the attachment to Instance (%s)", vID, d.Get("instance_id").(string))
+	return true
+}
+
+// logStaleVolumeAttachment warns when an "available" volume still lists an
+// attachment to the attachment's instance, as AWS occasionally does. Read only
+// reports it; if force_detach is set, Create clears it should attaching the
+// volume again fail because of it.
+func logStaleVolumeAttachment(d *schema.ResourceData, v *ec2.Volume) {
+	iID := d.Get("instance_id").(string)
+	for _, a := range v.Attachments {
+		if aws.StringValue(a.InstanceId) == iID {
+			volumeAttachmentLogf("WARN", d.Id(), "Volume (%s) is available but still lists an attachment to Instance (%s)",
+				*v.VolumeId, iID)
+			return
+		}
+	}
+}
+
+// clearStaleVolumeAttachment force detaches an "available" volume from the
+// instance if AWS still lists an attachment to it, so that attaching the
+// volume again isn't refused. Failures are only logged, as the attachment is
+// gone as far as AWS's volume state is concerned.
+func clearStaleVolumeAttachment(conn *instrumentedEC2Conn, id, volumeID, instanceID string) {
+	resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil || len(resp.Volumes) == 0 || aws.StringValue(resp.Volumes[0].State) != "available" {
+		return
+	}
+
+	for _, a := range resp.Volumes[0].Attachments {
+		if aws.StringValue(a.InstanceId) != instanceID {
+			continue
+		}
+
+		volumeAttachmentLogf("WARN", id, "Volume (%s) is available but still lists an attachment to Instance (%s), "+
+			"force detaching it (force_detach is set)", volumeID, instanceID)
+		_, err := conn.DetachVolume(&ec2.DetachVolumeInput{
+			InstanceId: aws.String(instanceID),
+			VolumeId:   aws.String(volumeID),
+			Force:      aws.Bool(true),
+		})
+		if err != nil {
+			volumeAttachmentLogf("WARN", id, "Error force detaching Volume (%s) from Instance (%s): %s",
+				volumeID, instanceID, err)
+		}
+		return
+	}
+}
+
+// volumeAttachmentPlannedCalls describes the EC2 API calls that creating (or,
+// if destroy is set, destroying) the attachment makes with its current
+// settings. It is only used for TRACE logging so that reviewers can audit
+// what an apply is going to do.
+func volumeAttachmentPlannedCalls(d *schema.ResourceData, destroy bool) []string {
+	name := d.Get("device_name").(string)
+	iID := d.Get("instance_id").(string)
+	vID := d.Get("volume_id").(string)
+
+	if !destroy {
+		return []string{
+			fmt.Sprintf("AttachVolume(Device=%s, InstanceId=%s, VolumeId=%s)", name, iID, vID),
+		}
+	}
+
+	if d.Get("skip_destroy").(bool) || d.Get("manage_lifecycle_only").(bool) {
+		return nil
+	}
+
+	detach := fmt.Sprintf("DetachVolume(Device=%s, InstanceId=%s, VolumeId=%s, Force=%t)",
+		name, iID, vID, d.Get("force_detach").(bool))
+	if !volumeAttachmentStopsInstanceOnDestroy(d) {
+		return []string{detach}
+	}
+	return []string{
+		fmt.Sprintf("StopInstances(InstanceIds=[%s])", iID),
+		detach,
+		fmt.Sprintf("StartInstances(InstanceIds=[%s])", iID),
+	}
+}
+
+// volumeAttachmentStopsInstanceOnDestroy reports whether destroying the
+// attachment with its current settings gets as far as stopping the instance
+// it is attached to. Delete only calls stopVolumeAttachmentInstance when it
+// does, which may still leave the instance alone depending on its state; see
+// volumeAttachmentInstanceStopSkipReason. An instance that was stopped is
+// started again after the detach.
+func volumeAttachmentStopsInstanceOnDestroy(d *schema.ResourceData) bool {
+	return !d.Get("skip_destroy").(bool) && !d.Get("manage_lifecycle_only").(bool) &&
+		!d.Get("dry_run").(bool) && d.Get("stop_instance_before_detaching").(bool) &&
+		!volumeAttachmentFireAndForget(d) && volumeAttachmentManagesInstancePower(d) &&
+		checkVolumeAttachmentRootDetach(d, d.Get("volume_id").(string), d.Get("instance_id").(string),
+			d.Get("is_root_device").(bool)) == nil
+}
+
+// volumeAttachmentFireAndForget reports whether detach_timeout_behavior is
+// "continue". Such a destroy is meant for scratch volumes: it never stops the
+// instance, and a detach that doesn't finish in time is left to complete on
+// its own.
+func volumeAttachmentFireAndForget(d *schema.ResourceData) bool {
+	return d.Get("detach_timeout_behavior").(string) == "continue"
+}
+
+// volumeAttachmentManagesInstancePower reports whether the resource may stop
+// or start the instance at all. Every StopInstances and StartInstances call
+// goes through a function that checks it first.
+func volumeAttachmentManagesInstancePower(d *schema.ResourceData) bool {
+	return d.Get("manage_instance_power").(bool)
+}
+
+func buildEBSVolumeARN(volumeID, partition, accountid, region string) (string, error) {
+	if partition == "" {
+		return "", fmt.Errorf("Unable to construct EBS volume ARN because of missing AWS partition")
+	}
+	if accountid == "" {
+		return "", fmt.Errorf("Unable to construct EBS volume ARN because of missing AWS Account ID")
+	}
+	arn := fmt.Sprintf("arn:%s:ec2:%s:%s:volume/%s", partition, region, accountid, volumeID)
+	return arn, nil
+}
+
+// Apart from delete_on_termination, all of the arguments that can be updated
+// in place only change how Terraform manages the attachment, so there is
+// nothing else to do in AWS.
+func resourceAwsVolumeAttachmentUpdate(d *schema.ResourceData, meta interface{}) error {
+	// delete_on_termination and tags only apply to a single volume_id
+	if _, ok := d.GetOk("attachments"); ok {
+		return resourceAwsVolumeAttachmentRead(d, meta)
+	}
+
+	client := volumeAttachmentAWSClient(d, meta)
+	conn := newInstrumentedEC2Conn(client)
+
+	// Only the changes that were applied are saved if one of them fails
+	d.Partial(true)
+
+	if d.HasChange("device_name") {
+		o, n := d.GetChange("device_name")
+		if err := moveVolumeAttachmentDevice(conn, client.autoscalingconn, d, o.(string), n.(string)); err != nil {
+			return err
+		}
+		d.SetPartial("device_name")
+	}
+
+	if d.HasChange("delete_on_termination") {
+		if err := setVolumeAttachmentDeleteOnTermination(conn, d, d.Get("delete_on_termination").(bool)); err != nil {
+			return err
+		}
+		d.SetPartial("delete_on_termination")
+	}
+
+	if d.HasChange("tags") {
+		o, n := d.GetChange("tags")
+		err := setVolumeAttachmentTags(conn, d.Id(), d.Get("volume_id").(string),
+			o.(map[string]interface{}), n.(map[string]interface{}))
+		if err != nil {
+			return err
+		}
+		d.SetPartial("tags")
+	}
+
+	d.Partial(false)
+
+	return resourceAwsVolumeAttachmentRead(d, meta)
+}
+
+// volumeAttachmentAttachedStateConf waits for the volume to be attached to the
+// instance as name. A new attachment may not be visible to DescribeVolumes
+// straight away, and some instance types report it as "busy" in between. It
+// can also briefly read as "attached" and then "attaching" again, so it has to
+// be seen attached attach_confirmations times in a row.
+func volumeAttachmentAttachedStateConf(conn *instrumentedEC2Conn, d *schema.ResourceData, id, vID, iID, name string,
+	timeout, delay, minTimeout time.Duration) *resource.StateChangeConf {
+	return &resource.StateChangeConf{
+		Pending:                   []string{"attaching", "busy"},
+		Target:                    []string{"attached"},
+		Refresh:                   volumeAttachmentNotFoundRefreshFunc(volumeAttachmentStateRefreshFunc(conn, id, vID, iID, name)),
+		Timeout:                   timeout,
+		Delay:                     delay,
+		MinTimeout:                minTimeout,
+		NotFoundChecks:            d.Get("attach_not_found_checks").(int),
+		ContinuousTargetOccurence: volumeAttachmentConfirmations(d),
+	}
+}
+
+// moveVolumeAttachmentDevice moves the volume from oldName to newName on the
+// same instance, by detaching and attaching it again rather than replacing
+// the resource. The instance is stopped around the move as it would be for a
+// destroy, and the move is refused for the root device or only checked for a
+// dry run, as a destroy would be. skip_destroy and manage_lifecycle_only
+// promise never to detach the volume, so the move is refused with either set.
+// If the volume can't be attached as newName, it is attached as oldName again
+// so that it isn't left detached.
+func moveVolumeAttachmentDevice(conn *instrumentedEC2Conn, asgconn *autoscaling.AutoScaling, d *schema.ResourceData, oldName, newName string) error {
+	iID := d.Get("instance_id").(string)
+	vID := d.Get("volume_id").(string)
+
+	createTimeout, err := volumeAttachmentTimeout(d, "create", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	deleteTimeout, err := volumeAttachmentTimeout(d, "delete", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range []string{"skip_destroy", "manage_lifecycle_only"} {
+		if d.Get(k).(bool) {
+			return fmt.Errorf("Refusing to move Volume (%s) on Instance (%s) from %s to %s, which detaches it, "+
+				"while %s is set. Taint the attachment or replace it with one for the new device instead",
+				vID, iID, oldName, newName, k)
+		}
+	}
+
+	// The move detaches the volume, so it is guarded like a destroy
+	if err := checkVolumeAttachmentRootDetach(d, vID, iID, d.Get("is_root_device").(bool)); err != nil {
+		return err
+	}
+	if d.Get("dry_run").(bool) {
+		if err := dryRunVolumeAttachmentDetachVolume(conn, vID, iID, oldName, d.Get("force_detach").(bool)); err != nil {
+			return err
+		}
+		return fmt.Errorf("Dry run moving Volume (%s) on Instance (%s) from %s to %s succeeded, nothing was moved "+
+			"(unset dry_run to move it)", vID, iID, oldName, newName)
+	}
+
+	if err := volumeAttachmentDevices.claim(iID, newName, vID); err != nil {
+		return err
+	}
+
+	restartInstance := false
+	if volumeAttachmentStopsInstanceOnDestroy(d) {
+		restartInstance, err = stopVolumeAttachmentInstance(conn, asgconn, d)
+		if err != nil {
+			volumeAttachmentDevices.release(iID, newName, vID)
+			return err
+		}
+	}
+
+	err = moveVolumeAttachmentDeviceAttachment(conn, d, oldName, newName, createTimeout, deleteTimeout, delay, minTimeout)
+	if err != nil {
+		volumeAttachmentDevices.release(iID, newName, vID)
+	} else {
+		volumeAttachmentDevices.release(iID, oldName, vID)
+	}
+
+	if restartInstance {
+		if startErr := startVolumeAttachmentInstance(conn, d); startErr != nil {
+			if err != nil {
+				volumeAttachmentLogf("WARN", d.Id(), "Error starting Instance (%s) after a failed move: %s", iID, startErr)
+			} else {
+				err = startErr
+			}
+		}
+	}
+	return err
+}
+
+func moveVolumeAttachmentDeviceAttachment(conn *instrumentedEC2Conn, d *schema.ResourceData, oldName, newName string,
+	createTimeout, deleteTimeout, delay, minTimeout time.Duration) error {
+	iID := d.Get("instance_id").(string)
+	vID := d.Get("volume_id").(string)
+
+	volumeAttachmentLogf("INFO", d.Id(), "Moving Volume (%s) on Instance (%s) from %s to %s", vID, iID, oldName, newName)
+	_, err := conn.DetachVolume(&ec2.DetachVolumeInput{
+		Device:     aws.String(oldName),
+		InstanceId: aws.String(iID),
+		VolumeId:   aws.String(vID),
+		Force:      aws.Bool(d.Get("force_detach").(bool)),
+	})
+	if err != nil {
+		return fmt.Errorf("Error detaching Volume (%s) from Instance (%s) as %s: %s", vID, iID, oldName, err)
+	}
+
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"detaching", "busy"},
+		Target:     []string{"detached", "missing"},
+		Refresh:    volumeAttachmentStateRefreshFunc(conn, d.Id(), vID, iID, oldName),
+		Timeout:    deleteTimeout,
+		Delay:      delay,
+		MinTimeout: minTimeout,
+	}
+	if _, err := waitForVolumeAttachmentState(d.Id(), stateConf, fmt.Sprintf("Volume (%s) to detach from %s", vID, oldName)); err != nil {
+		return fmt.Errorf(
+			"Error waiting for Volume (%s) to detach from Instance (%s): %s",
+			vID, iID, err)
+	}
+
+	err = attachVolumeAttachmentDevice(conn, d, d.Id(), vID, iID, newName, createTimeout, delay, minTimeout)
+	if err == nil {
+		return nil
+	}
+
+	volumeAttachmentLogf("WARN", d.Id(), "Error attaching Volume (%s) as %s, attaching it as %s again: %s",
+		vID, newName, oldName, err)
+	if restoreErr := attachVolumeAttachmentDevice(conn, d, d.Id(), vID, iID, oldName, createTimeout, delay, minTimeout); restoreErr != nil {
+		volumeAttachmentLogf("WARN", d.Id(), "Error attaching Volume (%s) as %s again: %s", vID, oldName, restoreErr)
+	}
+	return err
+}
+
+// attachVolumeAttachmentDevice attaches the volume to the instance as name and
+// waits for the attachment as Create does.
+func attachVolumeAttachmentDevice(conn *instrumentedEC2Conn, d *schema.ResourceData, id, vID, iID, name string,
+	timeout, delay, minTimeout time.Duration) error {
+	if err := attachVolumeAttachmentVolume(conn, d, id, name, vID, iID, false, timeout, delay, minTimeout); err != nil {
+		return err
+	}
+
+	stateConf := volumeAttachmentAttachedStateConf(conn, d, id, vID, iID, name, timeout, delay, minTimeout)
+	if _, err := waitForVolumeAttachmentState(id, stateConf, fmt.Sprintf("Volume (%s) to attach as %s", vID, name)); err != nil {
+		return fmt.Errorf(
+			"Error waiting for Volume (%s) to attach to Instance: %s, error: %s",
+			vID, iID, err)
+	}
+	return nil
+}
+
+// setVolumeAttachmentDeleteOnTermination sets whether the volume is deleted
+// when the instance it is attached to is terminated.
+func setVolumeAttachmentDeleteOnTermination(conn *instrumentedEC2Conn, d *schema.ResourceData, deleteOnTermination bool) error {
+	iID := d.Get("instance_id").(string)
+	vID := d.Get("volume_id").(string)
+
+	volumeAttachmentLogf("DEBUG", d.Id(), "Setting DeleteOnTermination of Volume (%s) on Instance (%s) to %t",
+		vID, iID, deleteOnTermination)
+	_, err := conn.ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId: aws.String(iID),
+		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{
+			{
+				DeviceName: aws.String(d.Get("device_name").(string)),
+				Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
+					DeleteOnTermination: aws.Bool(deleteOnTermination),
+					VolumeId:            aws.String(vID),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf(
+			"Error setting DeleteOnTermination of Volume (%s) on Instance (%s): %s",
+			vID, iID, err)
+	}
+	return nil
+}
+
+// setVolumeAttachmentTags changes the tags on the volume from oldTags to
+// newTags, leaving any other tags on the volume alone. Tags are removed with
+// their values, so a tag that has since been set to something else by
+// another resource is kept.
+func setVolumeAttachmentTags(conn *instrumentedEC2Conn, id, volumeID string, oldTags, newTags map[string]interface{}) error {
+	create, remove := diffTags(tagsFromMap(oldTags), tagsFromMap(newTags))
+
+	if len(remove) > 0 {
+		volumeAttachmentLogf("DEBUG", id, "Removing tags %s from Volume (%s)", remove, volumeID)
+		_, err := conn.DeleteTags(&ec2.DeleteTagsInput{
+			Resources: []*string{aws.String(volumeID)},
+			Tags:      remove,
+		})
+		// The tags went with the volume
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidVolume.NotFound" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error removing tags from Volume (%s): %s", volumeID, err)
+		}
+	}
+	if len(create) > 0 {
+		volumeAttachmentLogf("DEBUG", id, "Tagging Volume (%s) with %s", volumeID, create)
+		_, err := conn.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{aws.String(volumeID)},
+			Tags:      create,
+		})
+		if err != nil {
+			return fmt.Errorf("Error tagging Volume (%s): %s", volumeID, err)
+		}
+	}
+	return nil
+}
+
+func resourceAwsVolumeAttachmentDelete(d *schema.ResourceData, meta interface{}) error {
+	client := volumeAttachmentAWSClient(d, meta)
+	conn := newInstrumentedEC2Conn(client)
+
+	vID := d.Get("volume_id").(string)
+	iID := d.Get("instance_id").(string)
+
+	// The device's claim is only dropped once the volume is off it, or once
+	// the attachment leaves state without detaching anything, so that another
+	// attachment can't claim it while a failed destroy leaves it attached.
+	releaseDevice := func() {
+		volumeAttachmentDevices.release(iID, d.Get("device_name").(string), vID)
+		for _, e := range volumeAttachmentBatch(d) {
+			volumeAttachmentDevices.release(iID, e.device, e.volumeID)
+		}
+	}
+
+	if _, ok := d.GetOk("skip_destroy"); ok {
+		volumeAttachmentLogf("INFO", d.Id(), "Found skip_destroy to be true, removing from state")
+		releaseDevice()
+		d.SetId("")
+		return nil
+	}
+
+	if _, ok := d.GetOk("manage_lifecycle_only"); ok {
+		volumeAttachmentLogf("INFO", d.Id(), "Found manage_lifecycle_only to be true, removing from state")
+		releaseDevice()
+		d.SetId("")
+		return nil
+	}
+
+	if _, ok := d.GetOk("attachments"); ok {
+		return resourceAwsVolumeAttachmentBatchDelete(d, meta)
+	}
+
+	deleteTimeout, err := volumeAttachmentTimeout(d, "delete", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
+	}
+
+	// A previous destroy may have been interrupted part way through, so look
+	// at where the attachment and instance currently stand and only repeat
+	// the steps that haven't completed yet.
+	attachment, attachmentState, err := volumeAttachmentStateRefreshFunc(conn, d.Id(), vID, iID, d.Get("device_name").(string))()
+	if err != nil {
+		return fmt.Errorf(
+			"Error reading Volume (%s) attachment to Instance (%s): %s",
+			vID, iID, err)
+	}
+
+	// Detaching the last remaining attachment of a Multi-Attach volume
+	// leaves it fully detached, which is controlled by last_attachment_behavior.
+	// Only a volume that the last refresh saw attached to several instances
+	// is treated as Multi-Attach; every other volume has a single attachment,
+	// which is never the "last" one in this sense.
+	lastAttachmentBehavior := d.Get("last_attachment_behavior").(string)
+	// State written before the default was set may not store a value
+	if lastAttachmentBehavior == "" {
+		lastAttachmentBehavior = "ignore"
+	}
+	lastAttachment := false
+	if lastAttachmentBehavior != "ignore" && d.Get("volume_attachment_count").(int) > 1 &&
+		attachmentState != "detached" && attachmentState != "missing" && attachmentState != "gone" {
+		count, err := volumeAttachmentCount(conn, vID)
+		if err != nil {
+			return err
+		}
+		lastAttachment = count <= 1
+	}
+
+	// Set when we stopped an instance that was running, so that it can be
+	// started again once the volume is detached.
+	restartInstance := false
+	restart := func() error {
+		if !restartInstance {
+			return nil
+		}
+		restartInstance = false
+		return startVolumeAttachmentInstance(conn, d)
+	}
+	// Don't leave the instance stopped when any later step fails; a later
+	// destroy stops it again.
+	defer func() {
+		if err := restart(); err != nil {
+			volumeAttachmentLogf("WARN", d.Id(), "Error starting Instance (%s) after a failed destroy: %s", iID, err)
+		}
+	}()
+
+	switch attachmentState {
+	case "gone":
+		volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) no longer exists, treating it as detached", vID)
+		releaseDevice()
+		d.SetId("")
+		return nil
+	case "detached", "missing":
+		volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) is already detached from Instance (%s)", vID, iID)
+		if err := setVolumeAttachmentTags(conn, d.Id(), vID, d.Get("tags").(map[string]interface{}), nil); err != nil {
+			return err
+		}
+		releaseDevice()
+		d.SetId("")
+		return nil
+	case "detaching":
+		volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) is already detaching from Instance (%s)", vID, iID)
+	default:
+		if lastAttachment && lastAttachmentBehavior == "error" {
+			return fmt.Errorf(
+				"Volume (%s) is only attached to Instance (%s), refusing to detach its last attachment "+
+					"(last_attachment_behavior is \"error\")", vID, iID)
+		}
+
+		if err := checkVolumeAttachmentRootDetach(d, vID, iID, d.Get("is_root_device").(bool)); err != nil {
+			return err
+		}
+
+		if d.Get("dry_run").(bool) {
+			return dryRunVolumeAttachmentDetach(conn, d)
+		}
+
+		if volumeAttachmentStopsInstanceOnDestroy(d) {
+			asgconn := client.autoscalingconn
+			restartInstance, err = stopVolumeAttachmentInstance(conn, asgconn, d)
+			if err != nil {
+				return err
+			}
+		}
+
+		if d.Get("snapshot_before_detach").(bool) {
+			if err := snapshotVolumeAttachmentVolume(conn, d); err != nil {
+				return err
+			}
+		}
+
+		// Give applications a chance to flush in-flight I/O. This is best
+		// effort only; nothing checks that they have.
+		if grace := d.Get("pre_detach_grace_seconds").(int); grace > 0 {
+			volumeAttachmentLogf("DEBUG", d.Id(), "Waiting %ds before detaching Volume (%s) from Instance (%s)", grace, vID, iID)
+			volumeAttachmentSleep(time.Duration(grace) * time.Second)
+		}
+
+		if d.Get("force_detach").(bool) {
+			volumeAttachmentLogf("WARN", d.Id(), "force detaching Volume (%s) from Instance (%s); "+
+				"any file system on it should have been unmounted first, or data may be lost", vID, iID)
+		}
+
+		// The device in state can be stale, e.g. after the volume was
+		// remounted, and DetachVolume fails if it doesn't match. Prefer the
+		// live device, and detach by volume alone if it isn't known.
+		name := d.Get("device_name").(string)
+		device := ""
+		if a, ok := attachment.(*ec2.VolumeAttachment); ok && a != nil && a.Device != nil {
+			if *a.Device != name {
+				volumeAttachmentLogf("INFO", d.Id(), "Volume (%s) is attached to Instance (%s) as %s rather than %s",
+					vID, iID, *a.Device, name)
+			}
+			device = *a.Device
+		}
+
+		err = detachVolumeAttachmentVolume(conn, d.Id(), vID, iID, device, d.Get("force_detach").(bool), deleteTimeout)
+		if err != nil {
+			awsErr, ok := err.(awserr.Error)
+			if ok && awsErr.Code() == "InvalidVolume.NotFound" {
+				volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) no longer exists, treating it as detached", vID)
+				if err := restart(); err != nil {
+					return err
+				}
+				releaseDevice()
+				d.SetId("")
+				return nil
+			}
+
+			hint := ""
+			if !volumeAttachmentManagesInstancePower(d) {
+				hint = " (manage_instance_power is false, so the instance was not stopped; " +
+					"stop it, or unmount the volume, before destroying the attachment)"
+			}
+			if ok {
+				return fmt.Errorf("Error detaching Volume (%s) from Instance (%s), %s%s",
+					vID, iID, volumeAttachmentAWSErrorDetails(awsErr), hint)
+			}
+			return fmt.Errorf("Error detaching Volume (%s) from Instance (%s): %s%s", vID, iID, err, hint)
+		}
+	}
+
+	// An unset force_detach_after never escalates to a forced detach
+	if v, ok := d.GetOk("force_detach_after"); ok && !d.Get("force_detach").(bool) {
+		forceAfter, err := time.ParseDuration(v.(string))
+		if err != nil {
+			return err
+		}
+		if err := forceVolumeAttachmentDetachAfter(conn, d, forceAfter, delay, minTimeout); err != nil {
+			return err
+		}
+	}
+
+	// Some instance types report the attachment as "busy" while detaching
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"detaching", "busy"},
+		Target:     []string{"detached", "missing", "gone"},
+		Refresh:    volumeAttachmentStateRefreshFunc(conn, d.Id(), vID, iID, d.Get("device_name").(string)),
+		Timeout:    deleteTimeout,
+		Delay:      delay,
+		MinTimeout: minTimeout,
+	}
+
+	volumeAttachmentLogf("DEBUG", d.Id(), "Waiting for Volume (%s) to detach from Instance (%s)", vID, iID)
+	_, err = waitForVolumeAttachmentState(d.Id(), stateConf, fmt.Sprintf("Volume (%s) to detach from Instance (%s)", vID, iID))
+	if err != nil {
+		_, timedOut := err.(*resource.TimeoutError)
+		if !timedOut || !volumeAttachmentFireAndForget(d) {
+			return fmt.Errorf(
+				"Error waiting for Volume (%s) to detach from Instance (%s): %s",
+				vID, iID, err)
+		}
+
+		// The device keeps its claim, as the volume may still be on it
+		volumeAttachmentLogf("WARN", d.Id(), "Timed out waiting for Volume (%s) to detach from Instance (%s), "+
+			"removing the attachment from state anyway (detach_timeout_behavior is \"continue\")", vID, iID)
+		if err := restart(); err != nil {
+			return err
+		}
+		d.SetId("")
+		return nil
+	}
+
+	if d.Get("wait_for_attachment_cleanup").(bool) {
+		cleanupConf := &resource.StateChangeConf{
+			Pending:    []string{"lingering"},
+			Target:     []string{"clean"},
+			Refresh:    volumeAttachmentCleanupRefreshFunc(conn, vID, iID),
+			Timeout:    deleteTimeout,
+			Delay:      delay,
+			MinTimeout: minTimeout,
+		}
+
+		volumeAttachmentLogf("DEBUG", d.Id(), "Waiting for Volume (%s) to drop its attachment record for Instance (%s)", vID, iID)
+		if _, err := waitForVolumeAttachmentState(d.Id(), cleanupConf, fmt.Sprintf("Volume (%s) attachment records to clear", vID)); err != nil {
+			return fmt.Errorf(
+				"Error waiting for Volume (%s) to drop its attachment to Instance (%s): %s",
+				vID, iID, err)
+		}
+	}
+
+	if d.Get("wait_for_device_release").(bool) {
+		name := d.Get("device_name").(string)
+		releaseConf := &resource.StateChangeConf{
+			Pending:    []string{"mapped"},
+			Target:     []string{"released"},
+			Refresh:    volumeAttachmentDeviceRefreshFunc(conn, vID, iID, name),
+			Timeout:    deleteTimeout,
+			Delay:      delay,
+			MinTimeout: minTimeout,
+		}
+
+		volumeAttachmentLogf("DEBUG", d.Id(), "Waiting for Instance (%s) to drop Volume (%s) from %s", iID, vID, name)
+		if _, err := waitForVolumeAttachmentState(d.Id(), releaseConf, fmt.Sprintf("Instance (%s) to release %s", iID, name)); err != nil {
+			return fmt.Errorf(
+				"Error waiting for Instance (%s) to drop Volume (%s) from %s: %s",
+				iID, vID, name, err)
+		}
+	}
+
+	if (lastAttachment && lastAttachmentBehavior == "wait") || d.Get("wait_for_available").(bool) {
+		availableConf := &resource.StateChangeConf{
+			Pending:    []string{"in-use"},
+			Target:     []string{"available"},
+			Refresh:    volumeStateRefreshFunc(conn, vID),
+			Timeout:    deleteTimeout,
+			Delay:      delay,
+			MinTimeout: minTimeout,
+		}
+
+		volumeAttachmentLogf("DEBUG", d.Id(), "Waiting for Volume (%s) to become available", vID)
+		if _, err := waitForVolumeAttachmentState(d.Id(), availableConf, fmt.Sprintf("Volume (%s) to become available", vID)); err != nil {
+			return fmt.Errorf(
+				"Error waiting for Volume (%s) to become available: %s",
+				vID, err)
+		}
+	}
+
+	if err := restart(); err != nil {
+		return err
+	}
+
+	if err := setVolumeAttachmentTags(conn, d.Id(), vID, d.Get("tags").(map[string]interface{}), nil); err != nil {
+		return err
+	}
+
+	releaseDevice()
+	d.SetId("")
+	return nil
+}
+
+// detachVolumeAttachmentVolume calls DetachVolume for the volume and instance,
+// without waiting for the volume to detach. An empty device detaches the
+// volume by volume and instance alone. The OS may not have released the device
+// yet, even for a forced detach, so the call is retried until it has. A volume
+// that turns out not to be attached any more counts as detached.
+func detachVolumeAttachmentVolume(conn *instrumentedEC2Conn, id, vID, iID, device string, force bool, timeout time.Duration) error {
+	opts := &ec2.DetachVolumeInput{
+		InstanceId: aws.String(iID),
+		VolumeId:   aws.String(vID),
+		Force:      aws.Bool(force),
+	}
+	if device != "" {
+		opts.Device = aws.String(device)
+		volumeAttachmentLogf("DEBUG", id, "Detaching Volume (%s) from Instance (%s) as %s", vID, iID, device)
+	} else {
+		volumeAttachmentLogf("DEBUG", id, "Detaching Volume (%s) from Instance (%s) without a device name", vID, iID)
+	}
+
+	return resource.Retry(timeout, func() *resource.RetryError {
+		_, err := conn.DetachVolume(opts)
+		awsErr, ok := err.(awserr.Error)
+		if !ok {
+			if err != nil {
+				return resource.NonRetryableError(err)
+			}
+			return nil
+		}
+		switch awsErr.Code() {
+		case "VolumeInUse":
+		case "InvalidAttachment.NotFound":
+			// Detached by someone else since the state was read
+			volumeAttachmentLogf("DEBUG", id, "Volume (%s) is no longer attached to Instance (%s)", vID, iID)
+			return nil
+		case "IncorrectState":
+			// Also returned once the volume has detached after all
+			_, state, stateErr := volumeAttachmentStateRefreshFunc(conn, id, vID, iID, device)()
+			if stateErr == nil && state != "attached" {
+				return nil
+			}
+		default:
+			return resource.NonRetryableError(err)
+		}
+		volumeAttachmentLogf("DEBUG", id, "Volume (%s) is not ready to detach yet: %s", vID, err)
+		return resource.RetryableError(err)
+	})
+}
+
+// volumeAttachmentBatchEntry is one volume of the attachments block.
+type volumeAttachmentBatchEntry struct {
+	device   string
+	volumeID string
+}
+
+// volumeAttachmentBatch returns the volumes of the attachments block, ordered
+// by device name.
+func volumeAttachmentBatch(d *schema.ResourceData) []volumeAttachmentBatchEntry {
+	var entries []volumeAttachmentBatchEntry
+	for _, raw := range d.Get("attachments").(*schema.Set).List() {
+		m := raw.(map[string]interface{})
+		entries = append(entries, volumeAttachmentBatchEntry{
+			device:   m["device_name"].(string),
+			volumeID: m["volume_id"].(string),
+		})
+	}
+	sort.Sort(volumeAttachmentBatchSort(entries))
+	return entries
+}
+
+type volumeAttachmentBatchSort []volumeAttachmentBatchEntry
+
+func (a volumeAttachmentBatchSort) Len() int           { return len(a) }
+func (a volumeAttachmentBatchSort) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a volumeAttachmentBatchSort) Less(i, j int) bool { return a[i].device < a[j].device }
+
+func volumeAttachmentBatchID(instanceID string, entries []volumeAttachmentBatchEntry) string {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%s-", instanceID))
+	for _, e := range entries {
+		buf.WriteString(fmt.Sprintf("%s-%s-", e.device, e.volumeID))
+	}
+
+	return fmt.Sprintf("vai-%d", hashcode.String(buf.String()))
+}
+
+// resourceAwsVolumeAttachmentBatchCreate attaches every volume of the
+// attachments block to the instance. All of them are attached before any is
+// waited on, so that the attachments complete together rather than one after
+// the other.
+func resourceAwsVolumeAttachmentBatchCreate(d *schema.ResourceData, meta interface{}, iID string) error {
+	conn := newInstrumentedEC2Conn(volumeAttachmentAWSClient(d, meta))
+	entries := volumeAttachmentBatch(d)
+	id := volumeAttachmentBatchID(iID, entries)
+
+	createTimeout, err := volumeAttachmentTimeout(d, "create", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
+	}
+
+	if d.Get("dry_run").(bool) {
+		return dryRunVolumeAttachmentBatchAttach(conn, d, id, iID, entries, createTimeout, delay, minTimeout)
+	}
+
+	var attached []interface{}
+	for _, e := range entries {
+		if err := volumeAttachmentDevices.claim(iID, e.device, e.volumeID); err != nil {
+			return volumeAttachmentBatchPartial(d, id, attached, err)
+		}
+
+		attach, err := prepareVolumeAttachmentAttach(conn, d, id, e.device, e.volumeID, iID, false, createTimeout, delay, minTimeout)
+		if err == nil && attach {
+			err = attachVolumeAttachmentVolume(conn, d, id, e.device, e.volumeID, iID, false, createTimeout, delay, minTimeout)
+		}
+		if err != nil {
+			volumeAttachmentDevices.release(iID, e.device, e.volumeID)
+			return volumeAttachmentBatchPartial(d, id, attached, err)
+		}
+
+		attached = append(attached, map[string]interface{}{
+			"device_name": e.device,
+			"volume_id":   e.volumeID,
+		})
+	}
+
+	// Every volume is waited on, so that the error names all those that
+	// failed to attach rather than only the first
+	var errs *multierror.Error
+	for _, e := range entries {
+		stateConf := volumeAttachmentAttachedStateConf(conn, d, id, e.volumeID, iID, e.device, createTimeout, delay, minTimeout)
+		if _, err := waitForVolumeAttachmentState(id, stateConf, fmt.Sprintf("Volume (%s) to attach to Instance (%s)", e.volumeID, iID)); err != nil {
+			errs = multierror.Append(errs, volumeAttachmentBatchWaitError(e, err))
+		}
+	}
+	if errs != nil {
+		return volumeAttachmentBatchPartial(d, id, attached, fmt.Errorf(
+			"Error waiting for Volumes to attach to Instance (%s): %s", iID, errs))
+	}
+
+	d.SetId(id)
+	return resourceAwsVolumeAttachmentBatchRead(d, meta)
+}
+
+// volumeAttachmentBatchWaitError describes a failed wait for one volume of the
+// attachments block, naming its device, volume and the state it was left in.
+func volumeAttachmentBatchWaitError(e volumeAttachmentBatchEntry, err error) error {
+	state := "unknown"
+	switch err := err.(type) {
+	case *resource.TimeoutError:
+		state = err.LastState
+	case *resource.UnexpectedStateError:
+		state = err.State
+	case *resource.NotFoundError:
+		state = "missing"
+	}
+	return fmt.Errorf("%s (%s) is %s: %s", e.device, e.volumeID, state, err)
+}
+
+// volumeAttachmentBatchPartial records the volumes attached so far when a
+// batch create fails part way through, so that they are still detached on
+// destroy, and returns err.
+func volumeAttachmentBatchPartial(d *schema.ResourceData, id string, attached []interface{}, err error) error {
+	if len(attached) > 0 {
+		d.Set("attachments", attached)
+		d.SetId(id)
+	}
+	return err
+}
+
+// dryRunVolumeAttachmentBatchAttach checks that every volume of the
+// attachments block could be attached, without attaching any of them. Like a
+// single dry run attach, it records nothing in state.
+func dryRunVolumeAttachmentBatchAttach(conn *instrumentedEC2Conn, d *schema.ResourceData, id, iID string, entries []volumeAttachmentBatchEntry,
+	timeout, delay, minTimeout time.Duration) error {
+	for _, e := range entries {
+		if _, err := prepareVolumeAttachmentAttach(conn, d, id, e.device, e.volumeID, iID, true, timeout, delay, minTimeout); err != nil {
+			return err
+		}
+		if err := attachVolumeAttachmentVolume(conn, d, id, e.device, e.volumeID, iID, true, timeout, delay, minTimeout); err != nil {
+			return err
+		}
+	}
+
+	volumeAttachmentLogf("INFO", id, "Dry run attaching %d Volumes to Instance (%s) succeeded, nothing was attached", len(entries), iID)
+	return nil
+}
+
+// checkVolumeAttachmentBatchRootDetach applies checkVolumeAttachmentRootDetach
+// to every volume of the attachments block. The batch form doesn't read
+// is_root_device, so the instance's root device is looked up here.
+func checkVolumeAttachmentBatchRootDetach(conn *instrumentedEC2Conn, d *schema.ResourceData, iID string, entries []volumeAttachmentBatchEntry) error {
+	if d.Get("force_detach").(bool) || d.Get("allow_root_detach").(bool) {
+		return nil
+	}
+
+	resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(iID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading Instance (%s): %s", iID, err)
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil
+	}
+	root := aws.StringValue(resp.Reservations[0].Instances[0].RootDeviceName)
+	if root == "" {
+		return nil
+	}
+
+	for _, e := range entries {
+		isRoot := normalizeVolumeAttachmentDeviceName(e.device) == normalizeVolumeAttachmentDeviceName(root)
+		if err := checkVolumeAttachmentRootDetach(d, e.volumeID, iID, isRoot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resourceAwsVolumeAttachmentBatchRead drops the volumes of the attachments
+// block that are no longer attached to the instance, which forces the
+// resource to be replaced.
+func resourceAwsVolumeAttachmentBatchRead(d *schema.ResourceData, meta interface{}) error {
+	conn := newInstrumentedEC2Conn(volumeAttachmentAWSClient(d, meta))
+	iID := d.Get("instance_id").(string)
+
+	// Listing the instance's volumes rather than the volumes by ID means a
+	// deleted volume doesn't fail the whole request.
+	resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("attachment.instance-id"),
+				Values: []*string{aws.String(iID)},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading EC2 volumes for instance %s: %s", iID, err)
+	}
+
+	var found []interface{}
+	for _, e := range volumeAttachmentBatch(d) {
+		if a, _ := volumeAttachmentState(resp, e.volumeID, iID, e.device); a == nil {
+			volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) is no longer attached to Instance (%s)", e.volumeID, iID)
+			continue
+		}
+		found = append(found, map[string]interface{}{
+			"device_name": e.device,
+			"volume_id":   e.volumeID,
+		})
+	}
+
+	if len(found) == 0 {
+		volumeAttachmentLogf("DEBUG", d.Id(), "not found, removing from state")
+		d.SetId("")
+		return nil
+	}
+	d.Set("attachments", found)
+	return nil
+}
+
+// resourceAwsVolumeAttachmentBatchDelete detaches every volume of the
+// attachments block, stopping the instance only once for all of them.
+func resourceAwsVolumeAttachmentBatchDelete(d *schema.ResourceData, meta interface{}) error {
+	client := volumeAttachmentAWSClient(d, meta)
+	conn := newInstrumentedEC2Conn(client)
+	iID := d.Get("instance_id").(string)
+	entries := volumeAttachmentBatch(d)
+
+	deleteTimeout, err := volumeAttachmentTimeout(d, "delete", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVolumeAttachmentBatchRootDetach(conn, d, iID, entries); err != nil {
+		return err
+	}
+
+	force := d.Get("force_detach").(bool)
+	if d.Get("dry_run").(bool) {
+		for _, e := range entries {
+			if err := dryRunVolumeAttachmentDetachVolume(conn, e.volumeID, iID, e.device, force); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("Dry run detaching %d Volumes from Instance (%s) succeeded, nothing was detached "+
+			"and the attachment is kept in state (unset dry_run to detach them)", len(entries), iID)
+	}
+
+	restartInstance := false
+	restart := func() error {
+		if !restartInstance {
+			return nil
+		}
+		restartInstance = false
+		return startVolumeAttachmentInstance(conn, d)
+	}
+	// As for a single volume, a failed destroy doesn't leave the instance
+	// stopped
+	defer func() {
+		if err := restart(); err != nil {
+			volumeAttachmentLogf("WARN", d.Id(), "Error starting Instance (%s) after a failed destroy: %s", iID, err)
+		}
+	}()
+
+	if volumeAttachmentStopsInstanceOnDestroy(d) {
+		asgconn := client.autoscalingconn
+		restartInstance, err = stopVolumeAttachmentInstance(conn, asgconn, d)
+		if err != nil {
+			return err
+		}
+	}
+
+	if force {
+		volumeAttachmentLogf("WARN", d.Id(), "force detaching %d Volumes from Instance (%s); "+
+			"any file systems on them should have been unmounted first, or data may be lost", len(entries), iID)
+	}
+
+	for _, e := range entries {
+		err := detachVolumeAttachmentVolume(conn, d.Id(), e.volumeID, iID, e.device, force, deleteTimeout)
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidVolume.NotFound" {
+			volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) no longer exists, treating it as detached", e.volumeID)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error detaching Volume (%s) from Instance (%s): %s", e.volumeID, iID, err)
+		}
+	}
+
+	var errs *multierror.Error
+	for _, e := range entries {
+		stateConf := &resource.StateChangeConf{
+			Pending:    []string{"detaching", "busy"},
+			Target:     []string{"detached", "missing", "gone"},
+			Refresh:    volumeAttachmentStateRefreshFunc(conn, d.Id(), e.volumeID, iID, e.device),
+			Timeout:    deleteTimeout,
+			Delay:      delay,
+			MinTimeout: minTimeout,
+		}
+
+		if _, err := waitForVolumeAttachmentState(d.Id(), stateConf, fmt.Sprintf("Volume (%s) to detach from Instance (%s)", e.volumeID, iID)); err != nil {
+			errs = multierror.Append(errs, volumeAttachmentBatchWaitError(e, err))
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("Error waiting for Volumes to detach from Instance (%s): %s", iID, errs)
+	}
+
+	if err := restart(); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		volumeAttachmentDevices.release(iID, e.device, e.volumeID)
+	}
+	d.SetId("")
+	return nil
+}
+
+// volumeAttachmentCleanupRefreshFunc reports "lingering" while the volume
+// still carries an attachment record for the instance, in any state, and
+// "clean" once it is gone. A detached volume can keep such a record for a
+// short while, and until then attaching it again fails with VolumeInUse.
+func volumeAttachmentCleanupRefreshFunc(conn *instrumentedEC2Conn, volumeID, instanceID string) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(resp.Volumes) == 0 {
+			return volumeID, "clean", nil
+		}
+
+		v := resp.Volumes[0]
+		for _, a := range v.Attachments {
+			if a.InstanceId != nil && *a.InstanceId == instanceID {
+				return v, "lingering", nil
+			}
+		}
+		return v, "clean", nil
+	}
+}
+
+// volumeAttachmentDeviceRefreshFunc reports "mapped" while the instance's
+// block device mappings still list the volume on device, and "released" once
+// they don't. The mappings can lag behind a detach, and until they catch up
+// attaching another volume on the same device fails.
+func volumeAttachmentDeviceRefreshFunc(conn *instrumentedEC2Conn, volumeID, instanceID, device string) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+			return resp, "released", nil
+		}
+
+		for _, bdm := range resp.Reservations[0].Instances[0].BlockDeviceMappings {
+			if bdm.DeviceName == nil || bdm.Ebs == nil || bdm.Ebs.VolumeId == nil {
+				continue
+			}
+			if normalizeVolumeAttachmentDeviceName(*bdm.DeviceName) == normalizeVolumeAttachmentDeviceName(device) &&
+				*bdm.Ebs.VolumeId == volumeID {
+				return resp, "mapped", nil
+			}
+		}
+		return resp, "released", nil
+	}
+}
+
+// volumeAttachmentCount returns the number of instances volumeID is attached
+// to.
+func volumeAttachmentCount(conn *instrumentedEC2Conn, volumeID string) (int, error) {
+	resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error reading EC2 volume %s: %s", volumeID, err)
+	}
+	if len(resp.Volumes) == 0 {
+		return 0, nil
+	}
+	return len(resp.Volumes[0].Attachments), nil
+}
+
+// dryRunVolumeAttachmentDetach checks that the volume could be detached,
+// without stopping the instance or detaching anything. It always returns an
+// error, as returning nil from Delete would remove the attachment, which
+// still exists, from state.
+func dryRunVolumeAttachmentDetach(conn *instrumentedEC2Conn, d *schema.ResourceData) error {
+	iID := d.Get("instance_id").(string)
+	vID := d.Get("volume_id").(string)
+
+	err := dryRunVolumeAttachmentDetachVolume(conn, vID, iID, d.Get("device_name").(string), d.Get("force_detach").(bool))
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("Dry run detaching Volume (%s) from Instance (%s) succeeded, nothing was detached "+
+		"and the attachment is kept in state (unset dry_run to detach it)", vID, iID)
+}
+
+// dryRunVolumeAttachmentDetachVolume calls DetachVolume with DryRun set, and
+// returns nil if AWS reports that the detach would have succeeded.
+func dryRunVolumeAttachmentDetachVolume(conn *instrumentedEC2Conn, vID, iID, device string, force bool) error {
+	_, err := conn.DetachVolume(&ec2.DetachVolumeInput{
+		Device:     aws.String(device),
+		InstanceId: aws.String(iID),
+		VolumeId:   aws.String(vID),
+		Force:      aws.Bool(force),
+		DryRun:     aws.Bool(true),
+	})
+	if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "DryRunOperation" {
+		if ok {
+			return fmt.Errorf("Error dry run detaching Volume (%s) from Instance (%s), %s",
+				vID, iID, volumeAttachmentAWSErrorDetails(awsErr))
+		}
+		return fmt.Errorf("Error dry run detaching Volume (%s) from Instance (%s): %v", vID, iID, err)
+	}
+	return nil
+}
+
+// checkVolumeAttachmentRootDetach returns an error if isRoot is set, as
+// detaching the root device leaves the instance unable to boot, unless
+// force_detach or allow_root_detach is set.
+func checkVolumeAttachmentRootDetach(d *schema.ResourceData, vID, iID string, isRoot bool) error {
+	if !isRoot || d.Get("force_detach").(bool) || d.Get("allow_root_detach").(bool) {
+		return nil
+	}
+	return fmt.Errorf(
+		"Volume (%s) is the root device of Instance (%s), refusing to detach it "+
+			"(set allow_root_detach to detach it anyway)", vID, iID)
+}
+
+// forceDetachVolumeFromOtherInstances force-detaches the volume from any
+// instance other than instanceID and waits for the detach to finish, so that
+// a volume left wedged on a dead instance can be moved with force_detach.
+//
+// io1 and io2 volumes may have Multi-Attach enabled, which the API we use
+// doesn't report, so their healthy "attached" peers are left alone and only
+// attachments stuck "attaching" or "busy" are force-detached.
+func forceDetachVolumeFromOtherInstances(conn *instrumentedEC2Conn, id, volumeID, instanceID string, timeout, delay, minTimeout time.Duration) error {
+	resp, err := conn.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading EC2 volume %s: %s", volumeID, err)
+	}
+	if len(resp.Volumes) == 0 {
+		return nil
+	}
+
+	volumeType := aws.StringValue(resp.Volumes[0].VolumeType)
+	multiAttach := volumeType == "io1" || volumeType == "io2"
+	for _, a := range resp.Volumes[0].Attachments {
+		otherID := *a.InstanceId
+		if otherID == instanceID || *a.State == "detached" {
+			continue
+		}
+		if multiAttach && *a.State != "attaching" && *a.State != "busy" {
+			volumeAttachmentLogf("WARN", id, "Not force detaching %s Volume (%s) from Instance (%s), "+
+				"which may be a Multi-Attach peer (attachment is %s)", volumeType, volumeID, otherID, *a.State)
+			continue
+		}
+
+		volumeAttachmentLogf("WARN", id, "Force detaching Volume (%s) from Instance (%s) (force_detach is set)", volumeID, otherID)
+		_, err := conn.DetachVolume(&ec2.DetachVolumeInput{
+			InstanceId: aws.String(otherID),
+			VolumeId:   aws.String(volumeID),
+			Force:      aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("Error force detaching Volume (%s) from Instance (%s): %s", volumeID, otherID, err)
+		}
+
+		stateConf := &resource.StateChangeConf{
+			Pending:    []string{"attaching", "attached", "detaching", "busy"},
+			Target:     []string{"detached", "missing", "gone"},
+			Refresh:    volumeAttachmentStateRefreshFunc(conn, id, volumeID, otherID, ""),
+			Timeout:    timeout,
+			Delay:      delay,
+			MinTimeout: minTimeout,
+		}
+		if _, err := waitForVolumeAttachmentState(id, stateConf, fmt.Sprintf("Volume (%s) to detach from Instance (%s)", volumeID, otherID)); err != nil {
+			return fmt.Errorf(
+				"Error waiting for Volume (%s) to detach from Instance (%s): %s",
+				volumeID, otherID, err)
+		}
+	}
+
+	return nil
+}
+
+// stopVolumeAttachmentInstance stops the instance ahead of a detach and waits
+// for it to come to rest, reporting whether it stopped an instance that was
+// running. Instances that are already stopped (for example
+// because an earlier destroy was interrupted after stopping them) are left
+// alone, as are instances managed by an Auto Scaling group unless
+// stop_autoscaling_instances is set.
+func stopVolumeAttachmentInstance(conn *instrumentedEC2Conn, asgconn *autoscaling.AutoScaling, d *schema.ResourceData) (bool, error) {
+	instanceID := d.Get("instance_id").(string)
+
+	if !volumeAttachmentManagesInstancePower(d) {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Not stopping Instance (%s) (manage_instance_power is false)", instanceID)
+		return false, nil
+	}
+
+	timeout, err := volumeAttachmentTimeout(d, "delete", 10*time.Minute)
+	if err != nil {
+		return false, err
+	}
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return false, err
+	}
+
+	instance, state, err := InstanceStateRefreshFunc(conn, instanceID)()
+	if err != nil {
+		return false, err
+	}
+	reason, err := volumeAttachmentInstanceStopSkipReason(asgconn, d, instance, state)
+	if err != nil {
+		return false, err
+	}
+	if reason != "" {
+		volumeAttachmentLogf("WARN", d.Id(), "Detaching without stopping Instance (%s): %s", instanceID, reason)
+		return false, nil
+	}
+
+	if d.Get("error_if_stop_required").(bool) && (state == "running" || state == "pending") {
+		return false, fmt.Errorf(
+			"Instance (%s) is %s and would have to be stopped to detach the volume, "+
+				"which error_if_stop_required forbids. Stop the instance, or unmount the volume "+
+				"and set stop_instance_before_detaching to false", instanceID, state)
+	}
+
+	_, err = conn.StopInstances(&ec2.StopInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+
+	// The instance may have started stopping since it was read, e.g. for
+	// another attachment's destroy. It still has to be waited on before the
+	// detach, but it is left to whoever stopped it to start it again.
+	stoppedByUs := err == nil
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "IncorrectInstanceState" {
+			return false, fmt.Errorf("Error stopping Instance (%s): %s", instanceID, err)
+		}
+		volumeAttachmentLogf("DEBUG", d.Id(), "Instance (%s) is already stopping, waiting for it to stop: %s", instanceID, err)
+	}
 
-		Schema: map[string]*schema.Schema{
-			"device_name": {
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
-			},
+	// if the node is tainted it might end up getting terminated at the same
+	// time, and another operation may have been starting it when we stopped it
+	// Many attachments destroyed together all poll here, so spread the
+	// polls out and optionally cap them to stay clear of rate limits.
+	instanceStateConf := &resource.StateChangeConf{
+		Pending: []string{"pending", "stopping"},
+		Target:  []string{"stopped", "terminated"},
+		Refresh: volumeAttachmentLimitedRefreshFunc(InstanceStateRefreshFunc(conn, instanceID),
+			d.Get("stop_wait_max_attempts").(int), minTimeout/2),
+		Timeout:    timeout,
+		Delay:      delay,
+		MinTimeout: minTimeout,
+	}
+	volumeAttachmentLogf("DEBUG", d.Id(), "Stopping instance (%s)", instanceID)
+	i, err := waitForVolumeAttachmentState(d.Id(), instanceStateConf, fmt.Sprintf("Instance (%s) to stop", instanceID))
+	if err != nil {
+		if _, ok := err.(*resource.TimeoutError); ok {
+			err = volumeAttachmentStopTimeoutError(conn, d.Id(), instanceID, err)
+		}
+		return false, fmt.Errorf(
+			"Error waiting for Instance: %s to stop: %s",
+			instanceID, err)
+	}
 
-			"instance_id": {
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
-			},
+	// Only an instance we found running should be started again
+	stopped := *i.(*ec2.Instance).State.Name == "stopped"
+	return state == "running" && stopped && stoppedByUs, nil
+}
 
-			"volume_id": {
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
-			},
+// volumeAttachmentInstanceStopSkipReason reports why stopVolumeAttachmentInstance
+// leaves the instance as it is, or "" if it stops it. Read uses it as well so
+// that will_stop_instance_on_destroy agrees with what a destroy does.
+func volumeAttachmentInstanceStopSkipReason(asgconn *autoscaling.AutoScaling, d *schema.ResourceData, instance interface{}, state string) (string, error) {
+	instanceID := d.Get("instance_id").(string)
 
-			"force_detach": {
-				Type:     schema.TypeBool,
-				Optional: true,
-				Computed: true,
-			},
-			"skip_destroy": {
-				Type:     schema.TypeBool,
-				Optional: true,
-				Computed: true,
-			},
-		},
+	if state == "stopped" || state == "terminated" {
+		return fmt.Sprintf("it is already %s", state), nil
+	}
+
+	// Spot instances can't reliably be stopped and started again, and may be
+	// reclaimed part way through, so detach without stopping them.
+	if i, ok := instance.(*ec2.Instance); ok && aws.StringValue(i.InstanceLifecycle) == "spot" {
+		return "it is a Spot instance", nil
+	}
+
+	// Nitro instances expose volumes as NVMe devices, which can be detached
+	// while the instance runs, so error_if_stop_required doesn't require a
+	// stop there
+	if i, ok := instance.(*ec2.Instance); ok && d.Get("error_if_stop_required").(bool) && volumeAttachmentIsNitroInstance(i) {
+		return fmt.Sprintf("it is a Nitro instance (%s) and error_if_stop_required is set",
+			aws.StringValue(i.InstanceType)), nil
+	}
+
+	if d.Get("stop_autoscaling_instances").(bool) {
+		return "", nil
+	}
+	resp, err := asgconn.DescribeAutoScalingInstances(&autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "AccessDenied" {
+		// Without autoscaling:DescribeAutoScalingInstances the membership
+		// can't be checked, so carry on as for a standalone instance
+		volumeAttachmentLogf("WARN", d.Id(), "Not allowed to check Auto Scaling membership of Instance (%s), "+
+			"assuming it isn't in an Auto Scaling group: %s", instanceID, err)
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Error checking Auto Scaling membership of Instance (%s): %s", instanceID, err)
 	}
+	if len(resp.AutoScalingInstances) == 0 {
+		return "", nil
+	}
+
+	// Stopping the instance makes it fail its health checks, so the group
+	// would replace it (scale-in protection doesn't prevent that). Detach
+	// without stopping and leave the instance's lifecycle to the group.
+	asg := resp.AutoScalingInstances[0]
+	return fmt.Sprintf("it belongs to Auto Scaling group %q (protected from scale in: %t). "+
+		"Manage the instance's lifecycle through the group, or set stop_autoscaling_instances to stop it anyway",
+		aws.StringValue(asg.AutoScalingGroupName), aws.BoolValue(asg.ProtectedFromScaleIn)), nil
 }
 
-func resourceAwsVolumeAttachmentCreate(d *schema.ResourceData, meta interface{}) error {
-	conn := meta.(*AWSClient).ec2conn
-	name := d.Get("device_name").(string)
-	iID := d.Get("instance_id").(string)
+// forceVolumeAttachmentDetachAfter gives a clean detach up to after to
+// complete, so that the file system has a chance to flush, and then detaches
+// the volume again with Force so that the destroy still makes progress.
+func forceVolumeAttachmentDetachAfter(conn *instrumentedEC2Conn, d *schema.ResourceData, after, delay, minTimeout time.Duration) error {
 	vID := d.Get("volume_id").(string)
+	iID := d.Get("instance_id").(string)
 
-	opts := &ec2.AttachVolumeInput{
-		Device:     aws.String(name),
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"detaching", "busy"},
+		Target:     []string{"detached", "missing", "gone"},
+		Refresh:    volumeAttachmentStateRefreshFunc(conn, d.Id(), vID, iID, d.Get("device_name").(string)),
+		Timeout:    after,
+		Delay:      delay,
+		MinTimeout: minTimeout,
+	}
+	_, err := waitForVolumeAttachmentState(d.Id(), stateConf, fmt.Sprintf("Volume (%s) to detach cleanly from Instance (%s)", vID, iID))
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*resource.TimeoutError); !ok {
+		return fmt.Errorf(
+			"Error waiting for Volume (%s) to detach from Instance (%s): %s",
+			vID, iID, err)
+	}
+
+	volumeAttachmentLogf("WARN", d.Id(), "Volume (%s) has not detached from Instance (%s) after %s, force detaching it; "+
+		"data not yet flushed to it may be lost", vID, iID, after)
+	_, err = conn.DetachVolume(&ec2.DetachVolumeInput{
 		InstanceId: aws.String(iID),
 		VolumeId:   aws.String(vID),
+		Force:      aws.Bool(true),
+	})
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "InvalidAttachment.NotFound", "IncorrectState":
+			// Detached in the meantime
+			volumeAttachmentLogf("DEBUG", d.Id(), "Volume (%s) detached from Instance (%s) before it was forced: %s", vID, iID, err)
+			return nil
+		}
 	}
-
-	log.Printf("[DEBUG] Attaching Volume (%s) to Instance (%s)", vID, iID)
-	_, err := conn.AttachVolume(opts)
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			return fmt.Errorf("[WARN] Error attaching volume (%s) to instance (%s), message: \"%s\", code: \"%s\"",
-				vID, iID, awsErr.Message(), awsErr.Code())
-		}
-		return err
+		return fmt.Errorf("Error force detaching Volume (%s) from Instance (%s): %s", vID, iID, err)
 	}
+	return nil
+}
 
-	stateConf := &resource.StateChangeConf{
-		Pending:    []string{"attaching"},
-		Target:     []string{"attached"},
-		Refresh:    volumeAttachmentStateRefreshFunc(conn, vID, iID),
-		Timeout:    5 * time.Minute,
-		Delay:      10 * time.Second,
-		MinTimeout: 3 * time.Second,
+// volumeAttachmentStopTimeoutError reads the instance once more after its stop
+// timed out, so that the error says which state it was stuck in and why
+// rather than only that the wait timed out.
+func volumeAttachmentStopTimeoutError(conn *instrumentedEC2Conn, id, instanceID string, err error) error {
+	i, state, rerr := InstanceStateRefreshFunc(conn, instanceID)()
+	if rerr != nil || i == nil {
+		volumeAttachmentLogf("WARN", id, "Error reading Instance (%s) after its stop timed out: %v", instanceID, rerr)
+		return err
 	}
 
-	_, err = stateConf.WaitForState()
-	if err != nil {
-		return fmt.Errorf(
-			"Error waiting for Volume (%s) to attach to Instance: %s, error: %s",
-			vID, iID, err)
+	reason := "unknown"
+	if sr := i.(*ec2.Instance).StateReason; sr != nil && aws.StringValue(sr.Code) != "" {
+		reason = aws.StringValue(sr.Code)
 	}
-
-	d.SetId(volumeAttachmentID(name, vID, iID))
-	return resourceAwsVolumeAttachmentRead(d, meta)
+	return fmt.Errorf("instance %s stuck in %s; reason: %s (%s)", instanceID, state, reason, err)
 }
 
-func volumeAttachmentStateRefreshFunc(conn *ec2.EC2, volumeID, instanceID string) resource.StateRefreshFunc {
+// volumeAttachmentLimitedRefreshFunc wraps refresh so that it fails once it
+// has been called maxAttempts times (if maxAttempts is positive), and sleeps
+// for a random part of jitter before each call so that waiters started
+// together don't poll in step.
+func volumeAttachmentLimitedRefreshFunc(refresh resource.StateRefreshFunc, maxAttempts int, jitter time.Duration) resource.StateRefreshFunc {
+	attempts := 0
 	return func() (interface{}, string, error) {
-
-		request := &ec2.DescribeVolumesInput{
-			VolumeIds: []*string{aws.String(volumeID)},
-			Filters: []*ec2.Filter{
-				&ec2.Filter{
-					Name:   aws.String("attachment.instance-id"),
-					Values: []*string{aws.String(instanceID)},
-				},
-			},
+		if maxAttempts > 0 && attempts >= maxAttempts {
+			return nil, "", fmt.Errorf("gave up after %d attempts", maxAttempts)
 		}
+		attempts++
 
-		resp, err := conn.DescribeVolumes(request)
-		if err != nil {
-			if awsErr, ok := err.(awserr.Error); ok {
-				return nil, "failed", fmt.Errorf("code: %s, message: %s", awsErr.Code(), awsErr.Message())
-			}
-			return nil, "failed", err
-		}
+		volumeAttachmentJitter(jitter)
+		return refresh()
+	}
+}
 
-		if len(resp.Volumes) > 0 {
-			v := resp.Volumes[0]
-			for _, a := range v.Attachments {
-				if a.InstanceId != nil && *a.InstanceId == instanceID {
-					return a, *a.State, nil
-				}
-			}
-		}
-		// assume detached if volume count is 0
-		return 42, "detached", nil
+// volumeAttachmentJitter sleeps for a random part of jitter, if any.
+func volumeAttachmentJitter(jitter time.Duration) {
+	if jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(jitter))))
 	}
 }
-func resourceAwsVolumeAttachmentRead(d *schema.ResourceData, meta interface{}) error {
-	conn := meta.(*AWSClient).ec2conn
 
-	request := &ec2.DescribeVolumesInput{
-		VolumeIds: []*string{aws.String(d.Get("volume_id").(string))},
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name:   aws.String("attachment.instance-id"),
-				Values: []*string{aws.String(d.Get("instance_id").(string))},
-			},
-		},
+// waitForVolumeAttachmentState runs conf.WaitForState, logging how long the
+// wait for what took whether it succeeded or not, so that slow attaches and
+// detaches show up in debug logs.
+func waitForVolumeAttachmentState(id string, conf *resource.StateChangeConf, what string) (interface{}, error) {
+	start := time.Now()
+	v, err := conf.WaitForState()
+	if err != nil {
+		volumeAttachmentLogf("DEBUG", id, "Gave up waiting for %s after %s: %s", what, time.Since(start), err)
+	} else {
+		volumeAttachmentLogf("DEBUG", id, "Waited %s for %s", time.Since(start), what)
 	}
+	return v, err
+}
 
-	vols, err := conn.DescribeVolumes(request)
+// snapshotVolumeAttachmentVolume takes a snapshot of the attached volume ahead
+// of a detach, tags it with the instance and device it was detached from and
+// waits for it to reach the configured snapshot_wait_state.
+func snapshotVolumeAttachmentVolume(conn *instrumentedEC2Conn, d *schema.ResourceData) error {
+	name := d.Get("device_name").(string)
+	iID := d.Get("instance_id").(string)
+	vID := d.Get("volume_id").(string)
+
+	timeout, err := volumeAttachmentDuration(d, "snapshot_timeout", 10*time.Minute)
 	if err != nil {
-		if ec2err, ok := err.(awserr.Error); ok && ec2err.Code() == "InvalidVolume.NotFound" {
-			d.SetId("")
-			return nil
-		}
-		return fmt.Errorf("Error reading EC2 volume %s for instance: %s: %#v", d.Get("volume_id").(string), d.Get("instance_id").(string), err)
+		return err
 	}
 
-	if len(vols.Volumes) == 0 || *vols.Volumes[0].State == "available" {
-		log.Printf("[DEBUG] Volume Attachment (%s) not found, removing from state", d.Id())
-		d.SetId("")
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
+	}
+
+	waitState := d.Get("snapshot_wait_state").(string)
+	if waitState == "" {
+		waitState = "pending"
+	}
+
+	volumeAttachmentLogf("DEBUG", d.Id(), "Snapshotting Volume (%s) before detaching from Instance (%s)", vID, iID)
+	snapshot, err := conn.CreateSnapshot(&ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(vID),
+		Description: aws.String(fmt.Sprintf("Created by Terraform before detaching from %s (%s)", iID, name)),
+	})
+	if err != nil {
+		return fmt.Errorf("Error snapshotting Volume (%s) before detach: %s", vID, err)
+	}
+	sID := *snapshot.SnapshotId
+
+	_, err = conn.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(sID)},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("InstanceId"), Value: aws.String(iID)},
+			{Key: aws.String("DeviceName"), Value: aws.String(name)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error tagging Snapshot (%s) of Volume (%s): %s", sID, vID, err)
+	}
+
+	target := []string{"completed"}
+	if waitState == "pending" {
+		target = []string{"pending", "completed"}
+	}
+
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"pending"},
+		Target:     target,
+		Refresh:    volumeAttachmentSnapshotStateRefreshFunc(conn, sID),
+		Timeout:    timeout,
+		Delay:      delay,
+		MinTimeout: minTimeout,
+	}
+
+	_, err = waitForVolumeAttachmentState(d.Id(), stateConf, fmt.Sprintf("Snapshot (%s) to complete", sID))
+	if err != nil {
+		return fmt.Errorf(
+			"Error waiting for Snapshot (%s) of Volume (%s) to become %s: %s",
+			sID, vID, waitState, err)
 	}
 
+	volumeAttachmentLogf("INFO", d.Id(), "Created Snapshot (%s) of Volume (%s) before detach", sID, vID)
 	return nil
 }
 
-// InstanceStateRefreshFunc returns a resource.StateRefreshFunc that is used to watch
-// an EC2 instance.
-func InstanceStateRefreshFunc2(conn *ec2.EC2, instanceID string) resource.StateRefreshFunc {
+func volumeAttachmentSnapshotStateRefreshFunc(conn *instrumentedEC2Conn, snapshotID string) resource.StateRefreshFunc {
 	return func() (interface{}, string, error) {
-		resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
-			InstanceIds: []*string{aws.String(instanceID)},
+		resp, err := conn.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(snapshotID)},
 		})
 		if err != nil {
-			if ec2err, ok := err.(awserr.Error); ok && ec2err.Code() == "InvalidInstanceID.NotFound" {
-				// Set this to nil as if we didn't find anything.
-				resp = nil
-			} else {
-				log.Printf("Error on InstanceStateRefresh: %s", err)
-				return nil, "", err
+			if ec2err, ok := err.(awserr.Error); ok && ec2err.Code() == "InvalidSnapshot.NotFound" {
+				// The snapshot may not be visible yet
+				return nil, "", nil
 			}
+			return nil, "", err
 		}
 
-		if resp == nil || len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
-			// Sometimes AWS just has consistency issues and doesn't see
-			// our instance yet. Return an empty state.
+		if len(resp.Snapshots) == 0 {
 			return nil, "", nil
 		}
 
-		i := resp.Reservations[0].Instances[0]
-		return i, *i.State.Name, nil
+		s := resp.Snapshots[0]
+		return s, *s.State, nil
 	}
 }
 
-func resourceAwsVolumeAttachmentDelete(d *schema.ResourceData, meta interface{}) error {
-	conn := meta.(*AWSClient).ec2conn
+// volumeAttachmentTimeout returns the duration set for key ("create" or
+// "delete") in the timeouts block, or def if there isn't one.
+func volumeAttachmentTimeout(d *schema.ResourceData, key string, def time.Duration) (time.Duration, error) {
+	return volumeAttachmentDuration(d, fmt.Sprintf("timeouts.0.%s", key), def)
+}
 
-	if _, ok := d.GetOk("skip_destroy"); ok {
-		log.Printf("[INFO] Found skip_destroy to be true, removing attachment %q from state", d.Id())
-		d.SetId("")
+// volumeAttachmentDuration parses the duration string stored under key,
+// returning def when it has not been set.
+func volumeAttachmentDuration(d *schema.ResourceData, key string, def time.Duration) (time.Duration, error) {
+	v := d.Get(key).(string)
+	if v == "" {
+		return def, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// volumeAttachmentConfirmations returns how many times in a row a new
+// attachment has to be seen attached before the attach is done.
+func volumeAttachmentConfirmations(d *schema.ResourceData) int {
+	if v, ok := d.GetOk("attach_confirmations"); ok {
+		return v.(int)
+	}
+	return 2
+}
+
+// volumeAttachmentWaitTimes returns the Delay and MinTimeout for the
+// attachment waiters. Both are poll_interval when it is set.
+func volumeAttachmentWaitTimes(d *schema.ResourceData) (time.Duration, time.Duration, error) {
+	interval, err := volumeAttachmentDuration(d, "poll_interval", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if interval == 0 {
+		return volumeAttachmentWaitDelay, volumeAttachmentWaitMinTimeout, nil
+	}
+	return interval, interval, nil
+}
+
+func validateVolumeAttachmentDuration(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		errors = append(errors, fmt.Errorf(
+			"%q cannot be parsed as a duration: %s", k, err))
+	} else if duration <= 0 {
+		errors = append(errors, fmt.Errorf(
+			"%q must be greater than zero", k))
+	}
+	return
+}
+
+// volumeAttachmentAWSErrorDetails describes an AWS error for an error message,
+// including the request ID when AWS returned one so that it can be quoted in
+// a support case.
+func volumeAttachmentAWSErrorDetails(awsErr awserr.Error) string {
+	details := fmt.Sprintf("message: \"%s\", code: \"%s\"", awsErr.Message(), awsErr.Code())
+	if reqErr, ok := awsErr.(awserr.RequestFailure); ok && reqErr.RequestID() != "" {
+		details += fmt.Sprintf(", request ID: \"%s\"", reqErr.RequestID())
+	}
+	return details
+}
+
+var volumeAttachmentDeviceNameRegexp = regexp.MustCompile(`^(/dev/(sd|xvd)[a-z]{1,2}|xvd[a-z]{1,2})[0-9]*$`)
+
+// validateVolumeAttachmentDeviceName catches device names that AWS would
+// reject with an unhelpful error part way through an apply, such as `sdf`.
+func validateVolumeAttachmentDeviceName(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if !volumeAttachmentDeviceNameRegexp.MatchString(value) {
+		errors = append(errors, fmt.Errorf(
+			"%q must be a Linux device name such as /dev/sdf or /dev/xvdf, "+
+				"or a Windows device name such as xvdf, got %q", k, value))
+	}
+	return
+}
+
+// volumeAttachmentWindowsLinuxDeviceNameRegexp matches the /dev/ names that
+// Windows instances accept alongside xvd names: /dev/sda1 for the root device
+// and /dev/sd[b-e].
+var volumeAttachmentWindowsLinuxDeviceNameRegexp = regexp.MustCompile(`^/dev/(sda1|sd[b-e])$`)
+
+// checkVolumeAttachmentPlatformDeviceName returns an error if name follows the
+// device naming of the other platform than the instance's, which
+// validateVolumeAttachmentDeviceName can't tell without the instance: Windows
+// instances expect names such as xvdf, Linux ones names such as /dev/sdf. The
+// few /dev/ names that Windows instances accept too are let through.
+func checkVolumeAttachmentPlatformDeviceName(name, instanceID, platform string) error {
+	linuxName := strings.HasPrefix(name, "/dev/")
+	if platform == "windows" && linuxName && !volumeAttachmentWindowsLinuxDeviceNameRegexp.MatchString(name) {
+		return fmt.Errorf("device %s is a Linux device name but instance %s runs Windows, "+
+			"use a name such as xvdf, or one of /dev/sd[b-e]", name, instanceID)
+	}
+	if platform != "windows" && !linuxName {
+		return fmt.Errorf("device %s is a Windows device name but instance %s runs Linux, use a name such as /dev/sdf",
+			name, instanceID)
+	}
+	return nil
+}
+
+// startVolumeAttachmentInstance starts an instance that was stopped for a
+// detach and, unless wait_for_instance_running is false, waits for it to be
+// running again.
+func startVolumeAttachmentInstance(conn *instrumentedEC2Conn, d *schema.ResourceData) error {
+	instanceID := d.Get("instance_id").(string)
+
+	if !volumeAttachmentManagesInstancePower(d) {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Not starting Instance (%s) (manage_instance_power is false)", instanceID)
 		return nil
 	}
 
-	vID := d.Get("volume_id").(string)
-	iID := d.Get("instance_id").(string)
+	timeout, err := volumeAttachmentTimeout(d, "delete", 10*time.Minute)
+	if err != nil {
+		return err
+	}
 
-	instance_stop_opts := &ec2.StopInstancesInput{
-		InstanceIds: []*string{aws.String(iID)},
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
 	}
 
-	_, err := conn.StopInstances(instance_stop_opts)
+	volumeAttachmentLogf("DEBUG", d.Id(), "Starting instance (%s)", instanceID)
+	_, err = conn.StartInstances(&ec2.StartInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error starting Instance (%s) after detaching volume: %s", instanceID, err)
+	}
 
-	if err == nil {
-		// if the node is tainted it might end up getting terminated at the same time
-		instanceStateConf := &resource.StateChangeConf{
-			Pending:    []string{"stopping"},
-			Target:     []string{"stopped", "terminated"},
-			Refresh:    InstanceStateRefreshFunc2(conn, iID),
-			Timeout:    10 * time.Minute,
-			Delay:      10 * time.Second,
-			MinTimeout: 3 * time.Second,
-		}
-		log.Printf("[DEBUG] Stopping instance (%s)", iID)
-		_, err = instanceStateConf.WaitForState()
-		if err != nil {
-			return fmt.Errorf(
-				"Error waiting for Instance: %s to stop",
-				iID)
-		}
+	if !d.Get("wait_for_instance_running").(bool) {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Not waiting for Instance (%s) to be running (wait_for_instance_running is false)", instanceID)
+		return nil
 	}
 
-	opts := &ec2.DetachVolumeInput{
-		Device:     aws.String(d.Get("device_name").(string)),
-		InstanceId: aws.String(iID),
-		VolumeId:   aws.String(vID),
-		Force:      aws.Bool(d.Get("force_detach").(bool)),
+	return waitForVolumeAttachmentInstanceRunning(conn, d.Id(), instanceID, timeout, delay, minTimeout)
+}
+
+// startVolumeAttachmentInstanceAfterAttach starts the instance once the volume
+// has been attached, if start_instance_after_attach is set and the instance is
+// stopped, and waits for it to be running.
+func startVolumeAttachmentInstanceAfterAttach(conn *instrumentedEC2Conn, d *schema.ResourceData) error {
+	instanceID := d.Get("instance_id").(string)
+
+	if !volumeAttachmentManagesInstancePower(d) {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Not starting Instance (%s) (manage_instance_power is false)", instanceID)
+		return nil
 	}
 
-	_, err = conn.DetachVolume(opts)
-	stateConf := &resource.StateChangeConf{
-		Pending:    []string{"detaching"},
-		Target:     []string{"detached"},
-		Refresh:    volumeAttachmentStateRefreshFunc(conn, vID, iID),
-		Timeout:    5 * time.Minute,
-		Delay:      10 * time.Second,
-		MinTimeout: 3 * time.Second,
+	timeout, err := volumeAttachmentTimeout(d, "create", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		return err
 	}
 
-	log.Printf("[DEBUG] Detaching Volume (%s) from Instance (%s)", vID, iID)
-	_, err = stateConf.WaitForState()
+	_, state, err := InstanceStateRefreshFunc(conn, instanceID)()
 	if err != nil {
+		return fmt.Errorf("Error reading Instance (%s): %s", instanceID, err)
+	}
+	if state != "stopped" {
+		volumeAttachmentLogf("DEBUG", d.Id(), "Instance (%s) is %s, not starting it", instanceID, state)
+		return nil
+	}
+
+	volumeAttachmentLogf("DEBUG", d.Id(), "Starting instance (%s)", instanceID)
+	_, err = conn.StartInstances(&ec2.StartInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return fmt.Errorf("Error starting Instance (%s) after attaching volume: %s", instanceID, err)
+	}
+
+	return waitForVolumeAttachmentInstanceRunning(conn, d.Id(), instanceID, timeout, delay, minTimeout)
+}
+
+// waitForVolumeAttachmentInstanceRunning waits for an instance that has just
+// been started to be running.
+func waitForVolumeAttachmentInstanceRunning(conn *instrumentedEC2Conn, id, instanceID string, timeout, delay, minTimeout time.Duration) error {
+	instanceStateConf := &resource.StateChangeConf{
+		Pending:    []string{"pending", "stopped"},
+		Target:     []string{"running"},
+		Refresh:    InstanceStateRefreshFunc(conn, instanceID),
+		Timeout:    timeout,
+		Delay:      delay,
+		MinTimeout: minTimeout,
+	}
+	if _, err := waitForVolumeAttachmentState(id, instanceStateConf, fmt.Sprintf("Instance (%s) to be running", instanceID)); err != nil {
 		return fmt.Errorf(
-			"Error waiting for Volume (%s) to detach from Instance: %s",
-			vID, iID)
+			"Error waiting for Instance (%s) to start: %s",
+			instanceID, err)
 	}
-	d.SetId("")
+
 	return nil
 }
 
+// volumeAttachmentID returns the ID of the attachment of volumeID to
+// instanceID as name. The ID is a hash of "name-instanceID-volumeID-", in that
+// order; Create, import and the data source must all agree on it, and
+// changing it would replace every existing attachment on upgrade.
 func volumeAttachmentID(name, volumeID, instanceID string) string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("%s-", name))
@@ -259,3 +3064,163 @@ func volumeAttachmentID(name, volumeID, instanceID string) string {
 
 	return fmt.Sprintf("vai-%d", hashcode.String(buf.String()))
 }
+
+// volumeAttachmentAWSClient returns the provider's client, or a copy of it
+// whose EC2 and Auto Scaling clients talk to the attachment's region when that
+// is set and differs from the provider's. The copies are cached, so that each
+// call doesn't build a new session.
+func volumeAttachmentAWSClient(d *schema.ResourceData, meta interface{}) *AWSClient {
+	client := meta.(*AWSClient)
+	region := d.Get("region").(string)
+	if region == "" || region == client.region {
+		return client
+	}
+
+	volumeAttachmentRegionalClients.Lock()
+	defer volumeAttachmentRegionalClients.Unlock()
+
+	key := volumeAttachmentRegionalClientKey{client: client, region: region}
+	if regional, ok := volumeAttachmentRegionalClients.clients[key]; ok {
+		return regional
+	}
+
+	// The provider's endpoint overrides are for its own region
+	cfg := client.ec2conn.Config.Copy(&aws.Config{
+		Region:   aws.String(region),
+		Endpoint: aws.String(""),
+	})
+	sess := session.New(cfg)
+
+	regional := *client
+	regional.region = region
+	regional.ec2conn = ec2.New(sess)
+	regional.autoscalingconn = autoscaling.New(sess)
+	volumeAttachmentRegionalClients.clients[key] = &regional
+	return &regional
+}
+
+// volumeAttachmentRegionalClients holds the regional copies of the provider's
+// clients made by volumeAttachmentAWSClient, by provider client and region.
+var volumeAttachmentRegionalClients = &volumeAttachmentRegionalClientCache{
+	clients: make(map[volumeAttachmentRegionalClientKey]*AWSClient),
+}
+
+type volumeAttachmentRegionalClientCache struct {
+	sync.Mutex
+	clients map[volumeAttachmentRegionalClientKey]*AWSClient
+}
+
+type volumeAttachmentRegionalClientKey struct {
+	client *AWSClient
+	region string
+}
+
+// volumeAttachmentLogf logs at level with the attachment's ID in front of the
+// message, so that the lines for one attachment can be followed through an
+// apply that manages several.
+func volumeAttachmentLogf(level, id, format string, args ...interface{}) {
+	log.Printf("[%s] Volume Attachment (%s): %s", level, id, fmt.Sprintf(format, args...))
+}
+
+// volumeAttachmentDevices tracks the instance devices claimed by
+// aws_volume_attachment resources within this provider process, so that two
+// attachments in the same configuration targeting the same device of the same
+// instance fail with a clear error instead of racing each other through
+// AttachVolume. It is an apply-time guard for a single process only: it starts
+// empty with every run, so it knows nothing of attachments made by earlier
+// runs, other processes or outside Terraform. A claim is held from create
+// until destroy has detached the volume or dropped the attachment from state.
+var volumeAttachmentDevices = &volumeAttachmentDeviceRegistry{
+	devices: make(map[string]string),
+}
+
+type volumeAttachmentDeviceRegistry struct {
+	sync.Mutex
+	devices map[string]string
+}
+
+// claim records that volumeID is being attached to deviceName on instanceID.
+// It returns an error if a different volume already holds that device.
+func (r *volumeAttachmentDeviceRegistry) claim(instanceID, deviceName, volumeID string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	key := volumeAttachmentDeviceKey(instanceID, deviceName)
+	if existing, ok := r.devices[key]; ok && existing != volumeID {
+		return fmt.Errorf(
+			"Device %s on Instance (%s) is claimed by more than one aws_volume_attachment: volumes %s and %s",
+			deviceName, instanceID, existing, volumeID)
+	}
+	r.devices[key] = volumeID
+	return nil
+}
+
+// release drops the claim volumeID holds on deviceName, if any.
+func (r *volumeAttachmentDeviceRegistry) release(instanceID, deviceName, volumeID string) {
+	r.Lock()
+	defer r.Unlock()
+
+	key := volumeAttachmentDeviceKey(instanceID, deviceName)
+	if r.devices[key] == volumeID {
+		delete(r.devices, key)
+	}
+}
+
+func volumeAttachmentDeviceKey(instanceID, deviceName string) string {
+	return fmt.Sprintf("%s:%s", instanceID, normalizeVolumeAttachmentDeviceName(deviceName))
+}
+
+// volumeAttachmentInstanceTypeRegexp splits an instance type such as
+// "m5d.large" into its family prefix, generation and the rest.
+var volumeAttachmentInstanceTypeRegexp = regexp.MustCompile(`^([a-z]+)([0-9]+)[a-z-]*\.([a-z0-9-]+)$`)
+
+// volumeAttachmentNitroFamilies lists the instance families older than the
+// fifth generation that are built on Nitro.
+//
+// This is a maintained list: EC2 doesn't report whether an instance is Nitro,
+// so it has to be kept in step with the EC2 documentation's list of instances
+// built on the Nitro System as families are added. Families from the fifth
+// generation on are matched by volumeAttachmentIsNitroInstance without being
+// listed. TestVolumeAttachmentIsNitroInstance pins the known families on both
+// sides.
+var volumeAttachmentNitroFamilies = map[string]bool{
+	"a1": true, "d3": true, "d3en": true, "dl1": true, "g4ad": true,
+	"g4dn": true, "i3en": true, "im4gn": true, "inf1": true, "inf2": true,
+	"is4gen": true, "p3dn": true, "p4d": true, "p4de": true, "t3": true,
+	"t3a": true, "t4g": true, "trn1": true, "trn1n": true, "vt1": true,
+	"x2gd": true, "x2idn": true, "x2iedn": true, "x2iezn": true, "z1d": true,
+}
+
+// volumeAttachmentIsNitroInstance reports whether the instance runs on the
+// Nitro system, where EBS volumes are exposed as NVMe devices.
+// DescribeInstances reports the "xen" hypervisor for Nitro instances too, so
+// this goes by the instance type: every family from the fifth generation on
+// is Nitro, as are a few older ones, the High Memory (u-) instances and all
+// bare metal instances.
+func volumeAttachmentIsNitroInstance(i *ec2.Instance) bool {
+	instanceType := aws.StringValue(i.InstanceType)
+	family := strings.SplitN(instanceType, ".", 2)[0]
+	if volumeAttachmentNitroFamilies[family] || strings.HasPrefix(family, "u-") {
+		return true
+	}
+
+	m := volumeAttachmentInstanceTypeRegexp.FindStringSubmatch(instanceType)
+	if m == nil {
+		return false
+	}
+	if strings.HasPrefix(m[3], "metal") {
+		return true
+	}
+	generation, err := strconv.Atoi(m[2])
+	return err == nil && generation >= 5
+}
+
+// normalizeVolumeAttachmentDeviceName maps the equivalent spellings of a
+// device ("/dev/sdf", "sdf", "/dev/xvdf", "xvdf") onto a single name.
+func normalizeVolumeAttachmentDeviceName(name string) string {
+	name = strings.TrimPrefix(name, "/dev/")
+	if strings.HasPrefix(name, "sd") {
+		name = "xvd" + strings.TrimPrefix(name, "sd")
+	}
+	return name
+}
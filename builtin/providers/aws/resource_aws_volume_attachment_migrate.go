@@ -0,0 +1,94 @@
+package aws
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func resourceAwsVolumeAttachmentMigrateState(
+	v int, is *terraform.InstanceState, meta interface{}) (*terraform.InstanceState, error) {
+	var err error
+	switch v {
+	case 0:
+		log.Println("[INFO] Found AWS Volume Attachment State v0; migrating to v1")
+		is, err = migrateVolumeAttachmentStateV0toV1(is)
+		if err != nil {
+			return is, err
+		}
+		fallthrough
+	case 1:
+		log.Println("[INFO] Found AWS Volume Attachment State v1; migrating to v2")
+		is, err = migrateVolumeAttachmentStateV1toV2(is)
+		if err != nil {
+			return is, err
+		}
+		fallthrough
+	case 2:
+		log.Println("[INFO] Found AWS Volume Attachment State v2; migrating to v3")
+		return migrateVolumeAttachmentStateV2toV3(is)
+	default:
+		return is, fmt.Errorf("Unexpected schema version: %d", v)
+	}
+}
+
+// Attachments created before stop_instance_before_detaching existed always
+// stopped the instance on destroy. Stopping it is now opt-in, so they get the
+// schema's default of false like any other attachment rather than a value
+// that the next plan would change back. That changes what their destroy does,
+// so it is logged as a warning, and the CHANGELOG and 0.8 upgrade guide call
+// it out.
+func migrateVolumeAttachmentStateV0toV1(is *terraform.InstanceState) (*terraform.InstanceState, error) {
+	if is.Empty() || is.Attributes == nil {
+		log.Println("[DEBUG] Empty Volume Attachment State; nothing to migrate.")
+		return is, nil
+	}
+
+	log.Printf("[DEBUG] Attributes before migration: %#v", is.Attributes)
+
+	if is.Attributes["stop_instance_before_detaching"] == "" {
+		log.Printf("[WARN] Volume Attachment (%s): destroying it no longer stops the instance; "+
+			"set stop_instance_before_detaching to true to keep stopping it", is.ID)
+		is.Attributes["stop_instance_before_detaching"] = "false"
+	}
+
+	log.Printf("[DEBUG] Attributes after migration: %#v", is.Attributes)
+	return is, nil
+}
+
+// Attachments created before wait_for_instance_running existed always waited
+// for a restarted instance to be running again, so keep doing that.
+func migrateVolumeAttachmentStateV1toV2(is *terraform.InstanceState) (*terraform.InstanceState, error) {
+	if is.Empty() || is.Attributes == nil {
+		log.Println("[DEBUG] Empty Volume Attachment State; nothing to migrate.")
+		return is, nil
+	}
+
+	log.Printf("[DEBUG] Attributes before migration: %#v", is.Attributes)
+
+	if is.Attributes["wait_for_instance_running"] == "" {
+		is.Attributes["wait_for_instance_running"] = "true"
+	}
+
+	log.Printf("[DEBUG] Attributes after migration: %#v", is.Attributes)
+	return is, nil
+}
+
+// Attachments created before manage_instance_power existed were free to stop
+// and start the instance, so keep allowing that.
+func migrateVolumeAttachmentStateV2toV3(is *terraform.InstanceState) (*terraform.InstanceState, error) {
+	if is.Empty() || is.Attributes == nil {
+		log.Println("[DEBUG] Empty Volume Attachment State; nothing to migrate.")
+		return is, nil
+	}
+
+	log.Printf("[DEBUG] Attributes before migration: %#v", is.Attributes)
+
+	if is.Attributes["manage_instance_power"] == "" {
+		is.Attributes["manage_instance_power"] = "true"
+	}
+
+	log.Printf("[DEBUG] Attributes after migration: %#v", is.Attributes)
+	return is, nil
+}
@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestAWSVolumeAttachmentMigrateState(t *testing.T) {
+	cases := map[string]struct {
+		StateVersion int
+		Attributes   map[string]string
+		Expected     map[string]string
+		Meta         interface{}
+	}{
+		"v0_1_unset": {
+			StateVersion: 0,
+			Attributes: map[string]string{
+				"device_name": "/dev/sdh",
+			},
+			Expected: map[string]string{
+				"device_name":                    "/dev/sdh",
+				"stop_instance_before_detaching": "false",
+				"wait_for_instance_running":      "true",
+				"manage_instance_power":          "true",
+			},
+		},
+		"v0_1_explicit": {
+			StateVersion: 0,
+			Attributes: map[string]string{
+				"device_name":                    "/dev/sdh",
+				"stop_instance_before_detaching": "true",
+			},
+			Expected: map[string]string{
+				"device_name":                    "/dev/sdh",
+				"stop_instance_before_detaching": "true",
+			},
+		},
+		"v1_2_unset": {
+			StateVersion: 1,
+			Attributes: map[string]string{
+				"device_name":                    "/dev/sdh",
+				"stop_instance_before_detaching": "true",
+			},
+			Expected: map[string]string{
+				"device_name":                    "/dev/sdh",
+				"stop_instance_before_detaching": "true",
+				"wait_for_instance_running":      "true",
+			},
+		},
+		"v1_2_explicit": {
+			StateVersion: 1,
+			Attributes: map[string]string{
+				"device_name":               "/dev/sdh",
+				"wait_for_instance_running": "false",
+			},
+			Expected: map[string]string{
+				"device_name":               "/dev/sdh",
+				"wait_for_instance_running": "false",
+			},
+		},
+		"v2_3_unset": {
+			StateVersion: 2,
+			Attributes: map[string]string{
+				"device_name": "/dev/sdh",
+			},
+			Expected: map[string]string{
+				"device_name":           "/dev/sdh",
+				"manage_instance_power": "true",
+			},
+		},
+		"v2_3_explicit": {
+			StateVersion: 2,
+			Attributes: map[string]string{
+				"device_name":           "/dev/sdh",
+				"manage_instance_power": "false",
+			},
+			Expected: map[string]string{
+				"device_name":           "/dev/sdh",
+				"manage_instance_power": "false",
+			},
+		},
+	}
+
+	for tn, tc := range cases {
+		is := &terraform.InstanceState{
+			ID:         "vai-1234567890",
+			Attributes: tc.Attributes,
+		}
+		is, err := resourceAwsVolumeAttachmentMigrateState(
+			tc.StateVersion, is, tc.Meta)
+
+		if err != nil {
+			t.Fatalf("bad: %s, err: %#v", tn, err)
+		}
+
+		for k, v := range tc.Expected {
+			if is.Attributes[k] != v {
+				t.Fatalf(
+					"bad: %s\n\n expected: %#v -> %#v\n got: %#v -> %#v\n in: %#v",
+					tn, k, v, k, is.Attributes[k], is.Attributes)
+			}
+		}
+	}
+}
@@ -1,12 +1,25 @@
 package aws
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
 
@@ -62,6 +75,4231 @@ func TestAccAWSVolumeAttachment_skipDestroy(t *testing.T) {
 	})
 }
 
+func TestVolumeAttachmentDeviceRegistry_conflict(t *testing.T) {
+	r := &volumeAttachmentDeviceRegistry{devices: make(map[string]string)}
+
+	if err := r.claim("i-12345678", "/dev/sdh", "vol-aaaaaaaa"); err != nil {
+		t.Fatalf("unexpected error claiming device: %s", err)
+	}
+
+	// The same attachment being re-applied is not a conflict
+	if err := r.claim("i-12345678", "/dev/sdh", "vol-aaaaaaaa"); err != nil {
+		t.Fatalf("unexpected error re-claiming device: %s", err)
+	}
+
+	// A second attachment block for the same device, spelled differently
+	if err := r.claim("i-12345678", "xvdh", "vol-bbbbbbbb"); err == nil {
+		t.Fatalf("expected conflicting claim on xvdh to fail")
+	}
+
+	// Same device on a different instance is fine
+	if err := r.claim("i-87654321", "/dev/sdh", "vol-bbbbbbbb"); err != nil {
+		t.Fatalf("unexpected error claiming device on other instance: %s", err)
+	}
+
+	// Releasing from the wrong volume must not free the device
+	r.release("i-12345678", "/dev/sdh", "vol-bbbbbbbb")
+	if err := r.claim("i-12345678", "/dev/sdh", "vol-bbbbbbbb"); err == nil {
+		t.Fatalf("expected claim to fail after release by non-owner")
+	}
+
+	r.release("i-12345678", "/dev/sdh", "vol-aaaaaaaa")
+	if err := r.claim("i-12345678", "/dev/sdh", "vol-bbbbbbbb"); err != nil {
+		t.Fatalf("unexpected error claiming released device: %s", err)
+	}
+}
+
+func TestNormalizeVolumeAttachmentDeviceName(t *testing.T) {
+	cases := map[string]string{
+		"/dev/sdh":  "xvdh",
+		"sdh":       "xvdh",
+		"/dev/xvdh": "xvdh",
+		"xvdh":      "xvdh",
+		"/dev/hda":  "hda",
+	}
+
+	for in, expected := range cases {
+		if out := normalizeVolumeAttachmentDeviceName(in); out != expected {
+			t.Fatalf("normalizeVolumeAttachmentDeviceName(%q): expected %q, got %q", in, expected, out)
+		}
+	}
+}
+
+func TestVolumeAttachmentPlannedCalls(t *testing.T) {
+	d := testVolumeAttachmentResourceData()
+
+	create := volumeAttachmentPlannedCalls(d, false)
+	if len(create) != 1 || create[0] != "AttachVolume(Device=/dev/sdh, InstanceId=i-12345678, VolumeId=vol-12345678)" {
+		t.Fatalf("unexpected create calls: %#v", create)
+	}
+
+	destroy := volumeAttachmentPlannedCalls(d, true)
+	expected := []string{
+		"StopInstances(InstanceIds=[i-12345678])",
+		"DetachVolume(Device=/dev/sdh, InstanceId=i-12345678, VolumeId=vol-12345678, Force=false)",
+		"StartInstances(InstanceIds=[i-12345678])",
+	}
+	if !reflect.DeepEqual(destroy, expected) {
+		t.Fatalf("unexpected destroy calls: %#v", destroy)
+	}
+
+	d.Set("skip_destroy", true)
+	if calls := volumeAttachmentPlannedCalls(d, true); len(calls) != 0 {
+		t.Fatalf("expected no destroy calls with skip_destroy, got %#v", calls)
+	}
+}
+
+func TestVolumeAttachmentWaitTimes(t *testing.T) {
+	d := resourceAwsVolumeAttachment().TestResourceData()
+
+	delay, minTimeout, err := volumeAttachmentWaitTimes(d)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if delay != volumeAttachmentWaitDelay || minTimeout != volumeAttachmentWaitMinTimeout {
+		t.Fatalf("expected the default wait times, got %s and %s", delay, minTimeout)
+	}
+
+	d.Set("poll_interval", "30s")
+	delay, minTimeout, err = volumeAttachmentWaitTimes(d)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if delay != 30*time.Second || minTimeout != 30*time.Second {
+		t.Fatalf("expected wait times of 30s, got %s and %s", delay, minTimeout)
+	}
+
+	validate := resourceAwsVolumeAttachment().Schema["poll_interval"].ValidateFunc
+	for _, v := range []string{"500ms", "soon"} {
+		if _, errors := validate(v, "poll_interval"); len(errors) == 0 {
+			t.Fatalf("expected %q to be an invalid poll_interval", v)
+		}
+	}
+}
+
+// Removing a setting from the configuration must put it back to its default
+// on the next apply, rather than keep the value left in state.
+func TestResourceAwsVolumeAttachmentDiff_removedSettings(t *testing.T) {
+	cases := []struct {
+		Key      string
+		Old      string
+		Expected string
+	}{
+		{"force_detach_after", "2m", ""},
+		{"last_attachment_behavior", "error", "ignore"},
+		{"snapshot_wait_state", "completed", "pending"},
+		{"snapshot_timeout", "1h", "10m"},
+		{"pre_detach_grace_seconds", "30", "0"},
+		{"poll_interval", "30s", ""},
+		{"attach_not_found_checks", "5", "20"},
+		{"attach_confirmations", "5", "2"},
+		{"stop_wait_max_attempts", "5", "0"},
+		{"timeouts.#", "1", "0"},
+	}
+
+	for _, tc := range cases {
+		state := &terraform.InstanceState{
+			ID: "vai-1",
+			Attributes: map[string]string{
+				"device_name": "/dev/sdh",
+				"instance_id": "i-12345678",
+				"volume_id":   "vol-12345678",
+				tc.Key:        tc.Old,
+			},
+		}
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"device_name": "/dev/sdh",
+			"instance_id": "i-12345678",
+			"volume_id":   "vol-12345678",
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Key, err)
+		}
+
+		diff, err := resourceAwsVolumeAttachment().Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Key, err)
+		}
+		if diff == nil || diff.Attributes[tc.Key] == nil {
+			t.Fatalf("%s: expected removing it to produce a diff", tc.Key)
+		}
+		if attr := diff.Attributes[tc.Key]; attr.New != tc.Expected || attr.NewComputed {
+			t.Fatalf("%s: expected it to change from %q to %q, got %#v", tc.Key, tc.Old, tc.Expected, attr)
+		}
+	}
+}
+
+func TestValidateVolumeAttachmentDeviceName(t *testing.T) {
+	valid := []string{"/dev/sdf", "/dev/sda1", "/dev/xvdh", "/dev/xvdba", "xvdf"}
+	for _, v := range valid {
+		if _, errors := validateVolumeAttachmentDeviceName(v, "device_name"); len(errors) != 0 {
+			t.Fatalf("%q should be a valid device name: %q", v, errors)
+		}
+	}
+
+	invalid := []string{"sdf", "/dev/", "/dev/hdf", "/dev/sdF", "dev/sdf", "/dev/nvme1n1"}
+	for _, v := range invalid {
+		if _, errors := validateVolumeAttachmentDeviceName(v, "device_name"); len(errors) == 0 {
+			t.Fatalf("%q should be an invalid device name", v)
+		}
+	}
+}
+
+func TestVolumeAttachmentAWSErrorDetails(t *testing.T) {
+	err := awserr.New("VolumeInUse", "vol-12345678 is already attached", nil)
+	expected := `message: "vol-12345678 is already attached", code: "VolumeInUse"`
+	if details := volumeAttachmentAWSErrorDetails(err); details != expected {
+		t.Fatalf("expected %q, got %q", expected, details)
+	}
+
+	reqErr := awserr.NewRequestFailure(err, 400, "1a2b3c4d-0000-1111-2222-333344445555")
+	expected += `, request ID: "1a2b3c4d-0000-1111-2222-333344445555"`
+	if details := volumeAttachmentAWSErrorDetails(reqErr); details != expected {
+		t.Fatalf("expected %q, got %q", expected, details)
+	}
+}
+
+func TestVolumeAttachmentTimeout(t *testing.T) {
+	d := resourceAwsVolumeAttachment().TestResourceData()
+
+	timeout, err := volumeAttachmentTimeout(d, "delete", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if timeout != 5*time.Minute {
+		t.Fatalf("expected default delete timeout of 5m, got %s", timeout)
+	}
+
+	d.Set("timeouts", []interface{}{
+		map[string]interface{}{"delete": "20m"},
+	})
+
+	timeout, err = volumeAttachmentTimeout(d, "delete", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if timeout != 20*time.Minute {
+		t.Fatalf("expected delete timeout of 20m, got %s", timeout)
+	}
+
+	timeout, err = volumeAttachmentTimeout(d, "create", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if timeout != 5*time.Minute {
+		t.Fatalf("expected default create timeout of 5m, got %s", timeout)
+	}
+
+	for _, v := range []string{"0s", "-1m", "soon"} {
+		if _, errors := validateVolumeAttachmentDuration(v, "delete"); len(errors) != 1 {
+			t.Fatalf("expected %q to be an invalid timeout, got %v", v, errors)
+		}
+	}
+}
+
+func TestBuildEBSVolumeARN(t *testing.T) {
+	arn, err := buildEBSVolumeARN("vol-12345678", "aws-us-gov", "123456789012", "us-gov-west-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "arn:aws-us-gov:ec2:us-gov-west-1:123456789012:volume/vol-12345678"
+	if arn != expected {
+		t.Fatalf("expected %q, got %q", expected, arn)
+	}
+
+	if _, err := buildEBSVolumeARN("vol-12345678", "aws", "", "us-west-2"); err == nil {
+		t.Fatalf("expected error with missing account ID")
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead(t *testing.T) {
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		if r.Operation.Name == "DescribeVolumes" {
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached", "i-87654321")
+			// The device was renamed outside of Terraform
+			out.Volumes[0].Attachments[0].Device = aws.String("/dev/sdf")
+			out.Volumes[0].Attachments[0].AttachTime = aws.Time(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC))
+			out.Volumes[0].Size = aws.Int64(100)
+			out.Volumes[0].VolumeType = aws.String("gp2")
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	id := d.Id()
+	if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Id() != id {
+		t.Fatalf("expected ID to stay %q after the device changed, got %q", id, d.Id())
+	}
+
+	for k, v := range map[string]string{
+		"device_name":      "/dev/sdf",
+		"instance_id":      "i-12345678",
+		"volume_id":        "vol-12345678",
+		"attachment_state": "attached",
+		"attach_time":      "2017-01-02T03:04:05Z",
+		"volume_type":      "gp2",
+	} {
+		if actual := d.Get(k).(string); actual != v {
+			t.Fatalf("expected %s to be %q, got %q", k, v, actual)
+		}
+	}
+	if count := d.Get("volume_attachment_count").(int); count != 2 {
+		t.Fatalf("expected volume_attachment_count to be 2, got %d", count)
+	}
+	if size := d.Get("volume_size").(int); size != 100 {
+		t.Fatalf("expected volume_size to be 100, got %d", size)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_localFlags(t *testing.T) {
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		if r.Operation.Name == "DescribeVolumes" {
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "attached")
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("skip_destroy", true)
+	if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	attrs := d.State().Attributes
+	if attrs["force_detach"] != "false" {
+		t.Fatalf("expected force_detach to be persisted as false, got %q", attrs["force_detach"])
+	}
+	if attrs["skip_destroy"] != "true" {
+		t.Fatalf("expected skip_destroy to be persisted as true, got %q", attrs["skip_destroy"])
+	}
+}
+
+func TestResourceAwsVolumeAttachmentUpdate_localFlags(t *testing.T) {
+	conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		if r.Operation.Name == "DescribeVolumes" {
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "attached")
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("force_detach", true)
+	d.Set("skip_destroy", true)
+	if err := resourceAwsVolumeAttachmentUpdate(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Changing the flags only needs the attachment to be read back
+	if !reflect.DeepEqual(*calls, []string{"DescribeVolumes", "DescribeInstances"}) {
+		t.Fatalf("expected the attachment only to be read back, got %v", *calls)
+	}
+	attrs := d.State().Attributes
+	if attrs["force_detach"] != "true" || attrs["skip_destroy"] != "true" {
+		t.Fatalf("expected force_detach and skip_destroy to be persisted, got %q and %q",
+			attrs["force_detach"], attrs["skip_destroy"])
+	}
+}
+
+func TestResourceAwsVolumeAttachment_multiAttach(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	// One Multi-Attach volume shared by two attachments
+	attached := map[string]bool{"i-12345678": true, "i-87654321": true}
+	var detaches []string
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			v := &ec2.Volume{VolumeId: aws.String("vol-12345678"), State: aws.String("in-use")}
+			for _, id := range []string{"i-12345678", "i-87654321"} {
+				if attached[id] {
+					v.Attachments = append(v.Attachments, &ec2.VolumeAttachment{
+						Device:     aws.String("/dev/sdh"),
+						InstanceId: aws.String(id),
+						VolumeId:   aws.String("vol-12345678"),
+						State:      aws.String("attached"),
+					})
+				}
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{v}}
+		case "DetachVolume":
+			id := *r.Params.(*ec2.DetachVolumeInput).InstanceId
+			detaches = append(detaches, id)
+			attached[id] = false
+		}
+	})
+	client := &AWSClient{ec2conn: conn}
+
+	var attachments []*schema.ResourceData
+	for _, id := range []string{"i-12345678", "i-87654321"} {
+		d := testVolumeAttachmentResourceData()
+		d.Set("instance_id", id)
+		d.Set("stop_instance_before_detaching", false)
+		d.SetId(volumeAttachmentID("/dev/sdh", "vol-12345678", id))
+		if err := resourceAwsVolumeAttachmentRead(d, client); err != nil {
+			t.Fatalf("%s: unexpected error: %s", id, err)
+		}
+		if d.Id() == "" {
+			t.Fatalf("%s: expected the attachment to be found", id)
+		}
+		if count := d.Get("volume_attachment_count").(int); count != 2 {
+			t.Fatalf("%s: expected volume_attachment_count to be 2, got %d", id, count)
+		}
+		attachments = append(attachments, d)
+	}
+
+	// Destroying one attachment leaves the other in place
+	if err := resourceAwsVolumeAttachmentDelete(attachments[0], client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(detaches, []string{"i-12345678"}) {
+		t.Fatalf("expected only i-12345678 to be detached, got %v", detaches)
+	}
+	if err := resourceAwsVolumeAttachmentRead(attachments[1], client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if attachments[1].Id() == "" {
+		t.Fatalf("expected the attachment to i-87654321 to remain")
+	}
+	if count := attachments[1].Get("volume_attachment_count").(int); count != 1 {
+		t.Fatalf("expected volume_attachment_count to be 1, got %d", count)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_attachedElsewhere(t *testing.T) {
+	conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		if r.Operation.Name != "DescribeVolumes" {
+			return
+		}
+		// Apply the instance filter, which the volume no longer matches now
+		// that it has moved to another instance in the same account
+		for _, f := range r.Params.(*ec2.DescribeVolumesInput).Filters {
+			if *f.Name == "attachment.instance-id" && *f.Values[0] != "i-87654321" {
+				return
+			}
+		}
+		*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+			"vol-12345678", "i-12345678", "detached", "i-87654321")
+	})
+
+	d := testVolumeAttachmentResourceData()
+	if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Id() != "" {
+		t.Fatalf("expected ID to be cleared, got %q", d.Id())
+	}
+
+	expected := []string{"DescribeVolumes", "DescribeVolumes"}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_instanceTerminated(t *testing.T) {
+	for _, state := range []string{"shutting-down", "terminated"} {
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", "attached")
+			case "DescribeInstances":
+				*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+					"i-12345678", state)
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+			t.Fatalf("%s: unexpected error: %s", state, err)
+		}
+		if d.Id() != "" {
+			t.Fatalf("%s: expected ID to be cleared, got %q", state, d.Id())
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_nitroDevice(t *testing.T) {
+	cases := []struct {
+		InstanceType string
+		ExpectDevice string
+	}{
+		{InstanceType: "m5.large", ExpectDevice: "/dev/sdh"},
+		{InstanceType: "m4.large", ExpectDevice: "/dev/nvme1n1"},
+	}
+
+	for _, tc := range cases {
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+				out.Volumes[0].Attachments[0].Device = aws.String("/dev/nvme1n1")
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "DescribeInstances":
+				// AWS reports the xen hypervisor for Nitro instances as well
+				out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+				out.Reservations[0].Instances[0].Hypervisor = aws.String("xen")
+				out.Reservations[0].Instances[0].InstanceType = aws.String(tc.InstanceType)
+				*r.Data.(*ec2.DescribeInstancesOutput) = out
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		if err := resourceAwsVolumeAttachmentRead(d, client); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.InstanceType, err)
+		}
+		if name := d.Get("device_name").(string); name != tc.ExpectDevice {
+			t.Fatalf("%s: expected device_name to be %s, got %s", tc.InstanceType, tc.ExpectDevice, name)
+		}
+	}
+}
+
+func TestVolumeAttachmentIsNitroInstance(t *testing.T) {
+	cases := map[string]bool{
+		"m5.large":         true,
+		"c6gn.xlarge":      true,
+		"r5ad.24xlarge":    true,
+		"t3a.micro":        true,
+		"i3en.large":       true,
+		"i3.metal":         true,
+		"u-6tb1.112xlarge": true,
+		"m4.large":         false,
+		"t2.micro":         false,
+		"i3.large":         false,
+		"c4.8xlarge":       false,
+		"":                 false,
+	}
+
+	// Pin the known families on both sides, so that a change to the list
+	// or the generation rule shows up here
+	nitro := []string{
+		"a1", "d3", "d3en", "dl1", "g4ad", "g4dn", "i3en", "im4gn", "inf1", "inf2",
+		"is4gen", "p3dn", "p4d", "p4de", "t3", "t3a", "t4g", "trn1", "trn1n", "vt1",
+		"x2gd", "x2idn", "x2iedn", "x2iezn", "z1d",
+		"c5", "c5n", "m5", "m5zn", "r5b", "c6g", "m6i", "r6a", "c7g", "m7i",
+	}
+	xen := []string{
+		"c1", "c3", "c4", "d2", "f1", "g2", "g3", "h1", "i2", "i3",
+		"m1", "m2", "m3", "m4", "p2", "p3", "r3", "r4", "t1", "t2", "x1", "x1e",
+	}
+	for _, family := range nitro {
+		cases[family+".xlarge"] = true
+	}
+	for _, family := range xen {
+		cases[family+".xlarge"] = false
+	}
+
+	for instanceType, expected := range cases {
+		i := &ec2.Instance{InstanceType: aws.String(instanceType), Hypervisor: aws.String("xen")}
+		if actual := volumeAttachmentIsNitroInstance(i); actual != expected {
+			t.Fatalf("%q: expected %t, got %t", instanceType, expected, actual)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachment_rootDevice(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		ForceDetach     bool
+		AllowRootDetach bool
+		ExpectError     bool
+	}{
+		{ExpectError: true},
+		{ForceDetach: true},
+		{AllowRootDetach: true},
+	}
+
+	for _, tc := range cases {
+		detached := false
+		conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				state := "attached"
+				if detached {
+					state = "detached"
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			case "DescribeInstances":
+				out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+				out.Reservations[0].Instances[0].RootDeviceName = aws.String("/dev/xvdh")
+				*r.Data.(*ec2.DescribeInstancesOutput) = out
+			case "DetachVolume":
+				detached = true
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("stop_instance_before_detaching", false)
+		d.Set("force_detach", tc.ForceDetach)
+		d.Set("allow_root_detach", tc.AllowRootDetach)
+		if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !d.Get("is_root_device").(bool) {
+			t.Fatalf("expected /dev/sdh to be the root device /dev/xvdh")
+		}
+
+		*calls = nil
+		err := resourceAwsVolumeAttachmentDelete(d, &AWSClient{ec2conn: conn})
+		if tc.ExpectError {
+			if err == nil || detached {
+				t.Fatalf("expected the root device not to be detached, got calls %v", *calls)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("force_detach = %t, allow_root_detach = %t: unexpected error: %s",
+				tc.ForceDetach, tc.AllowRootDetach, err)
+		}
+		if !detached {
+			t.Fatalf("expected the root device to be detached, got calls %v", *calls)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_instanceState(t *testing.T) {
+	for _, state := range []string{"running", "stopped", ""} {
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", "attached")
+			case "DescribeInstances":
+				if state == "" {
+					r.Error = awserr.New("InvalidInstanceID.NotFound", "The instance ID 'i-12345678' does not exist", nil)
+					return
+				}
+				*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+					"i-12345678", state)
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("instance_state", "pending")
+		if err := resourceAwsVolumeAttachmentRead(d, client); err != nil {
+			t.Fatalf("%q: unexpected error: %s", state, err)
+		}
+		if got := d.Get("instance_state").(string); got != state {
+			t.Fatalf("expected instance_state %q, got %q", state, got)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_sharedVolume(t *testing.T) {
+	for _, state := range []string{"in-use", "available"} {
+		conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			if r.Operation.Name != "DescribeVolumes" {
+				return
+			}
+			// The instance filter matches nothing for a volume shared from
+			// another account
+			if len(r.Params.(*ec2.DescribeVolumesInput).Filters) > 0 {
+				return
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = ec2.DescribeVolumesOutput{
+				Volumes: []*ec2.Volume{
+					{VolumeId: aws.String("vol-12345678"), State: aws.String(state)},
+				},
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+			t.Fatalf("%s: unexpected error: %s", state, err)
+		}
+
+		expected := []string{"DescribeVolumes", "DescribeVolumes"}
+		if !reflect.DeepEqual(*calls, expected) {
+			t.Fatalf("%s: expected calls %v, got %v", state, expected, *calls)
+		}
+		if kept := d.Id() != ""; kept != (state == "in-use") {
+			t.Fatalf("%s: expected the attachment to be kept only for an in-use volume, got ID %q", state, d.Id())
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_iops(t *testing.T) {
+	for _, iops := range []int64{4000, 0} {
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+				if iops > 0 {
+					out.Volumes[0].VolumeType = aws.String("io1")
+					out.Volumes[0].Iops = aws.Int64(iops)
+				} else {
+					out.Volumes[0].VolumeType = aws.String("standard")
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "DescribeInstances":
+				*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+					"i-12345678", "running")
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("iops", 100)
+		if err := resourceAwsVolumeAttachmentRead(d, client); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := d.Get("iops").(int); int64(got) != iops {
+			t.Fatalf("expected iops %d, got %d", iops, got)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_willStopInstanceOnDestroy(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Name          string
+		InstanceState string
+		Spot          bool
+		AutoScaling   bool
+		RootDevice    bool
+		InstanceType  string
+		Set           map[string]interface{}
+		Expected      bool
+	}{
+		{Name: "running", InstanceState: "running", Expected: true},
+		{Name: "pending", InstanceState: "pending", Expected: true},
+		{Name: "stopped", InstanceState: "stopped"},
+		{Name: "spot", InstanceState: "running", Spot: true},
+		{Name: "auto scaling", InstanceState: "running", AutoScaling: true},
+		{
+			Name: "stop_autoscaling_instances", InstanceState: "running", AutoScaling: true,
+			Set: map[string]interface{}{"stop_autoscaling_instances": true}, Expected: true,
+		},
+		{Name: "dry_run", InstanceState: "running", Set: map[string]interface{}{"dry_run": true}},
+		{Name: "manage_instance_power", InstanceState: "running", Set: map[string]interface{}{"manage_instance_power": false}},
+		{Name: "continue", InstanceState: "running", Set: map[string]interface{}{"detach_timeout_behavior": "continue"}},
+		{Name: "root device", InstanceState: "running", RootDevice: true},
+		{
+			Name: "allow_root_detach", InstanceState: "running", RootDevice: true,
+			Set: map[string]interface{}{"allow_root_detach": true}, Expected: true,
+		},
+		{Name: "nitro", InstanceState: "running", InstanceType: "m5.large", Expected: true},
+		{
+			Name: "nitro error_if_stop_required", InstanceState: "running", InstanceType: "m5.large",
+			Set: map[string]interface{}{"error_if_stop_required": true},
+		},
+	}
+
+	for _, tc := range cases {
+		detached := false
+		instanceState := tc.InstanceState
+		stopped := false
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				state := "attached"
+				if detached {
+					state = "detached"
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			case "DescribeInstances":
+				out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", instanceState)
+				if tc.Spot {
+					out.Reservations[0].Instances[0].InstanceLifecycle = aws.String("spot")
+				}
+				if tc.RootDevice {
+					out.Reservations[0].Instances[0].RootDeviceName = aws.String("/dev/sdh")
+				}
+				if tc.InstanceType != "" {
+					out.Reservations[0].Instances[0].InstanceType = aws.String(tc.InstanceType)
+				}
+				*r.Data.(*ec2.DescribeInstancesOutput) = out
+			case "DescribeAutoScalingInstances":
+				if tc.AutoScaling {
+					*r.Data.(*autoscaling.DescribeAutoScalingInstancesOutput) = autoscaling.DescribeAutoScalingInstancesOutput{
+						AutoScalingInstances: []*autoscaling.InstanceDetails{
+							{AutoScalingGroupName: aws.String("web"), InstanceId: aws.String("i-12345678")},
+						},
+					}
+				}
+			case "StopInstances":
+				stopped = true
+				instanceState = "stopped"
+			case "StartInstances":
+				instanceState = "running"
+			case "DetachVolume":
+				if aws.BoolValue(r.Params.(*ec2.DetachVolumeInput).DryRun) {
+					r.Error = awserr.New("DryRunOperation", "Request would have succeeded", nil)
+					return
+				}
+				detached = true
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		for k, v := range tc.Set {
+			d.Set(k, v)
+		}
+		if err := resourceAwsVolumeAttachmentRead(d, client); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Name, err)
+		}
+		if got := d.Get("will_stop_instance_on_destroy").(bool); got != tc.Expected {
+			t.Fatalf("%s: expected will_stop_instance_on_destroy = %t, got %t", tc.Name, tc.Expected, got)
+		}
+
+		// The destroy itself must agree; it fails for the dry run and the
+		// guarded root device, neither of which stops anything
+		resourceAwsVolumeAttachmentDelete(d, client)
+		if stopped != tc.Expected {
+			t.Fatalf("%s: expected the destroy to stop the instance: %t, got %t", tc.Name, tc.Expected, stopped)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_encryption(t *testing.T) {
+	cases := []struct {
+		Encrypted bool
+		KmsKeyId  string
+	}{
+		{Encrypted: true, KmsKeyId: "arn:aws:kms:us-west-2:123456789012:key/1234abcd"},
+		{Encrypted: false},
+	}
+
+	for _, tc := range cases {
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+				out.Volumes[0].Encrypted = aws.Bool(tc.Encrypted)
+				if tc.KmsKeyId != "" {
+					out.Volumes[0].KmsKeyId = aws.String(tc.KmsKeyId)
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "DescribeInstances":
+				*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+					"i-12345678", "running")
+			}
+		})
+
+		// A volume that was re-created unencrypted must not keep the old key
+		d := testVolumeAttachmentResourceData()
+		d.Set("encrypted", true)
+		d.Set("kms_key_id", "arn:aws:kms:us-west-2:123456789012:key/old")
+		if err := resourceAwsVolumeAttachmentRead(d, client); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if d.Get("encrypted").(bool) != tc.Encrypted || d.Get("kms_key_id").(string) != tc.KmsKeyId {
+			t.Fatalf("expected encrypted = %t, kms_key_id = %q, got %t, %q", tc.Encrypted, tc.KmsKeyId,
+				d.Get("encrypted").(bool), d.Get("kms_key_id").(string))
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_staleAttachment(t *testing.T) {
+	// Read runs on every refresh and plan, so it must only report a stale
+	// attachment, even with force_detach set
+	for _, forceDetach := range []bool{false, true} {
+		conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			if r.Operation.Name == "DescribeVolumes" {
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+				out.Volumes[0].State = aws.String("available")
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("force_detach", forceDetach)
+		if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+			t.Fatalf("force_detach = %t: unexpected error: %s", forceDetach, err)
+		}
+		if d.Id() != "" {
+			t.Fatalf("force_detach = %t: expected ID to be cleared, got %q", forceDetach, d.Id())
+		}
+		for _, call := range *calls {
+			if call == "DetachVolume" {
+				t.Fatalf("force_detach = %t: expected Read not to detach anything, got calls %v", forceDetach, *calls)
+			}
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_notFound(t *testing.T) {
+	for _, code := range []string{"InvalidVolume.NotFound", "InvalidInstanceID.NotFound"} {
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			r.Error = awserr.New(code, "not found", nil)
+		})
+
+		d := testVolumeAttachmentResourceData()
+		if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+			t.Fatalf("%s: unexpected error: %s", code, err)
+		}
+		if d.Id() != "" {
+			t.Fatalf("%s: expected ID to be cleared, got %q", code, d.Id())
+		}
+	}
+}
+
+func TestVolumeAttachmentStateRefreshFunc(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Output    ec2.DescribeVolumesOutput
+		Error     error
+		State     string
+		ExpectErr bool
+	}{
+		{
+			Name:   "attached to the instance",
+			Output: testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached"),
+			State:  "attached",
+		},
+		{
+			Name:   "attaching to the instance",
+			Output: testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attaching"),
+			State:  "attaching",
+		},
+		{
+			Name:   "attached to another instance",
+			Output: testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "detached", "i-87654321"),
+			State:  "detached",
+		},
+		{
+			Name:   "no volumes",
+			Output: ec2.DescribeVolumesOutput{},
+			State:  "missing",
+		},
+		{
+			Name:  "volume deleted",
+			Error: awserr.New("InvalidVolume.NotFound", "The volume 'vol-12345678' does not exist.", nil),
+			State: "gone",
+		},
+		{
+			// Only retried when there is an earlier state to report
+			Name:      "throttled",
+			Error:     awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil),
+			State:     "failed",
+			ExpectErr: true,
+		},
+		{
+			Name:      "other AWS error",
+			Error:     awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil),
+			State:     "failed",
+			ExpectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			if tc.Error != nil {
+				r.Error = tc.Error
+				return
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = tc.Output
+		})
+
+		res, state, err := volumeAttachmentStateRefreshFunc(
+			newInstrumentedEC2Conn(&AWSClient{ec2conn: conn}), "vai-12345678", "vol-12345678", "i-12345678", "/dev/sdh")()
+		if state != tc.State {
+			t.Fatalf("%s: expected state %q, got %q", tc.Name, tc.State, state)
+		}
+		if tc.ExpectErr {
+			if err == nil {
+				t.Fatalf("%s: expected error", tc.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Name, err)
+		}
+		if _, ok := res.(*ec2.VolumeAttachment); !ok {
+			t.Fatalf("%s: expected a *ec2.VolumeAttachment result, got %#v", tc.Name, res)
+		}
+	}
+}
+
+func TestVolumeAttachmentStateRefreshFunc_throttled(t *testing.T) {
+	describes := 0
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		describes++
+		if describes > 1 {
+			r.Error = awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+			return
+		}
+		*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+			"vol-12345678", "i-12345678", "detaching")
+	})
+
+	f := volumeAttachmentStateRefreshFunc(
+		newInstrumentedEC2Conn(&AWSClient{ec2conn: conn}), "vai-12345678", "vol-12345678", "i-12345678", "/dev/sdh")
+	for i := 0; i < 2; i++ {
+		_, state, err := f()
+		if err != nil {
+			t.Fatalf("refresh %d: unexpected error: %s", i, err)
+		}
+		if state != "detaching" {
+			t.Fatalf("refresh %d: expected state detaching, got %q", i, state)
+		}
+	}
+
+	// With no earlier state to report, throttling is still an error
+	_, _, err := volumeAttachmentStateRefreshFunc(
+		newInstrumentedEC2Conn(&AWSClient{ec2conn: conn}), "vai-12345678", "vol-12345678", "i-12345678", "/dev/sdh")()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestVolumeAttachmentAWSClient_region(t *testing.T) {
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {})
+	client := &AWSClient{ec2conn: conn, region: "us-west-2"}
+
+	for _, region := range []string{"", "us-west-2"} {
+		d := testVolumeAttachmentResourceData()
+		d.Set("region", region)
+		if c := volumeAttachmentAWSClient(d, client); c != client {
+			t.Fatalf("region %q: expected the provider's client", region)
+		}
+	}
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("region", "eu-west-1")
+	c := volumeAttachmentAWSClient(d, client)
+	if c == client || c.region != "eu-west-1" || *c.ec2conn.Config.Region != "eu-west-1" ||
+		*c.autoscalingconn.Config.Region != "eu-west-1" {
+		t.Fatalf("expected clients for eu-west-1, got %#v", c)
+	}
+	if client.ec2conn != conn {
+		t.Fatalf("expected the provider's client to be left alone")
+	}
+
+	// The regional client is built once and then reused
+	if again := volumeAttachmentAWSClient(d, client); again != c {
+		t.Fatalf("expected the eu-west-1 client to be reused")
+	}
+	d.Set("region", "eu-central-1")
+	if other := volumeAttachmentAWSClient(d, client); other == c || other.region != "eu-central-1" {
+		t.Fatalf("expected a separate client for eu-central-1, got %#v", other)
+	}
+
+	if _, errs := resourceAwsVolumeAttachment().Schema["region"].ValidateFunc("moon-1", "region"); len(errs) == 0 {
+		t.Fatalf("expected an unknown region to be rejected")
+	}
+}
+
+func TestVolumeAttachmentID(t *testing.T) {
+	// These are pinned: a change to the ID would replace existing attachments
+	cases := []struct {
+		Name       string
+		VolumeID   string
+		InstanceID string
+		Expected   string
+	}{
+		{"/dev/sdh", "vol-12345678", "i-12345678", "vai-3897649985"},
+		{"xvdf", "vol-049df61146c4d7901", "i-0123456789abcdef0", "vai-1623150827"},
+	}
+
+	for _, tc := range cases {
+		if id := volumeAttachmentID(tc.Name, tc.VolumeID, tc.InstanceID); id != tc.Expected {
+			t.Fatalf("%s, %s, %s: expected ID %s, got %s", tc.Name, tc.VolumeID, tc.InstanceID, tc.Expected, id)
+		}
+	}
+
+	// The volume and instance are not interchangeable
+	if volumeAttachmentID("/dev/sdh", "vol-12345678", "i-12345678") == volumeAttachmentID("/dev/sdh", "i-12345678", "vol-12345678") {
+		t.Fatalf("expected the ID to depend on the order of volume and instance")
+	}
+}
+
+func TestVolumeAttachmentState_device(t *testing.T) {
+	// The volume was moved from /dev/sdf to /dev/sdh on the same instance,
+	// and the old attachment is still on its way out
+	out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+	out.Volumes[0].Attachments = append([]*ec2.VolumeAttachment{
+		{
+			Device:     aws.String("/dev/sdf"),
+			InstanceId: aws.String("i-12345678"),
+			VolumeId:   aws.String("vol-12345678"),
+			State:      aws.String("detaching"),
+		},
+	}, out.Volumes[0].Attachments...)
+
+	cases := []struct {
+		Device       string
+		ExpectDevice string
+		ExpectState  string
+	}{
+		{Device: "/dev/sdh", ExpectDevice: "/dev/sdh", ExpectState: "attached"},
+		{Device: "xvdh", ExpectDevice: "/dev/sdh", ExpectState: "attached"},
+		{Device: "/dev/sdf", ExpectDevice: "/dev/sdf", ExpectState: "detaching"},
+		// Falls back to the first attachment to the instance
+		{Device: "/dev/sdg", ExpectDevice: "/dev/sdf", ExpectState: "detaching"},
+	}
+
+	for _, tc := range cases {
+		a, state := volumeAttachmentState(&out, "vol-12345678", "i-12345678", tc.Device)
+		if a == nil || *a.Device != tc.ExpectDevice || state != tc.ExpectState {
+			t.Fatalf("%s: expected %s to be %s, got %s (%s)", tc.Device, tc.ExpectDevice, tc.ExpectState, a, state)
+		}
+	}
+
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		if r.Operation.Name == "DescribeVolumes" {
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		}
+	})
+	d := testVolumeAttachmentResourceData()
+	if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if state := d.Get("attachment_state").(string); state != "attached" {
+		t.Fatalf("expected Read to match the attachment on /dev/sdh, got state %q", state)
+	}
+}
+
+func TestVolumeAttachmentState_otherVolume(t *testing.T) {
+	// Another volume attached to the same instance is listed first
+	out := testVolumeAttachmentDescribeVolumesOutput("vol-87654321", "i-12345678", "attached")
+	ours := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "detaching")
+	out.Volumes = append(out.Volumes, ours.Volumes...)
+
+	a, state := volumeAttachmentState(&out, "vol-12345678", "i-12345678", "/dev/sdh")
+	if a == nil || *a.VolumeId != "vol-12345678" || state != "detaching" {
+		t.Fatalf("expected the attachment of vol-12345678 to be detaching, got %s (%s)", a, state)
+	}
+
+	out.Volumes = out.Volumes[:1]
+	if a, state := volumeAttachmentState(&out, "vol-12345678", "i-12345678", "/dev/sdh"); a != nil || state != "missing" {
+		t.Fatalf("expected vol-12345678 to be missing, got %s (%s)", a, state)
+	}
+}
+
+// TestResourceAwsVolumeAttachmentDelete runs Delete against the fake EC2 for
+// each combination of settings and instance or volume state that changes the
+// calls it makes.
+func TestResourceAwsVolumeAttachmentDelete(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	stopAndRestart := []string{
+		"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances", "StopInstances",
+		"DescribeInstances", "DetachVolume", "DescribeVolumes", "StartInstances", "DescribeInstances",
+	}
+	liveDetach := []string{"DescribeVolumes", "DescribeInstances", "DetachVolume", "DescribeVolumes"}
+
+	cases := []struct {
+		Name string
+		Fake testVolumeAttachmentFake
+		Set  map[string]interface{}
+		// ExpectCalls is left nil when the number of polls isn't fixed
+		ExpectCalls []string
+		// ExpectError lists what the error must contain, if one is expected
+		ExpectError []string
+		// ExpectForced is the Force flag of each DetachVolume call, if set
+		ExpectForced []bool
+		// ExpectInstance is the state the instance is left in, if set
+		ExpectInstance string
+	}{
+		{
+			// The instance is only started again once the volume is detached
+			Name:           "stop and restart",
+			ExpectCalls:    stopAndRestart,
+			ExpectInstance: "running",
+		},
+		{
+			// Only waiting for the instance reads it after starting it
+			Name:           "no wait for instance running",
+			Set:            map[string]interface{}{"wait_for_instance_running": false},
+			ExpectCalls:    stopAndRestart[:len(stopAndRestart)-1],
+			ExpectInstance: "running",
+		},
+		{
+			// The interrupted destroy already stopped the instance
+			Name:           "resume after stop",
+			Fake:           testVolumeAttachmentFake{Instance: "stopped"},
+			ExpectCalls:    liveDetach,
+			ExpectInstance: "stopped",
+		},
+		{
+			// The volume must not be detached from the running instance
+			// when it was asked to be stopped first
+			Name: "stop error",
+			Fake: testVolumeAttachmentFake{
+				Errors: map[string][]string{"StopInstances": {"UnauthorizedOperation"}},
+			},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances", "StopInstances",
+			},
+			ExpectError: []string{"UnauthorizedOperation"},
+		},
+		{
+			// One read before stopping, then three while waiting for the stop
+			Name: "stop wait max attempts",
+			Fake: testVolumeAttachmentFake{StopsTo: "stopping"},
+			Set:  map[string]interface{}{"stop_wait_max_attempts": 3},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances", "StopInstances",
+				"DescribeInstances", "DescribeInstances", "DescribeInstances",
+			},
+			ExpectError: []string{"gave up after 3 attempts"},
+		},
+		{
+			// A concurrent start leaves the instance pending before it stops
+			Name: "stop while pending",
+			Fake: testVolumeAttachmentFake{InstanceStates: []string{"running", "pending", "stopping"}},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances", "StopInstances",
+				"DescribeInstances", "DescribeInstances", "DescribeInstances", "DetachVolume",
+				"DescribeVolumes", "StartInstances", "DescribeInstances",
+			},
+			ExpectInstance: "running",
+		},
+		{
+			// The instance was stopped by someone else, so it isn't started
+			// again, and the volume is only detached once it has stopped
+			Name: "already stopping",
+			Fake: testVolumeAttachmentFake{
+				Instance:       "stopped",
+				InstanceStates: []string{"running", "stopping"},
+				Errors:         map[string][]string{"StopInstances": {"IncorrectInstanceState"}},
+			},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances", "StopInstances",
+				"DescribeInstances", "DescribeInstances", "DetachVolume", "DescribeVolumes",
+			},
+			ExpectInstance: "stopped",
+		},
+		{
+			Name:        "error_if_stop_required on m4.large",
+			Fake:        testVolumeAttachmentFake{InstanceType: "m4.large"},
+			Set:         map[string]interface{}{"error_if_stop_required": true},
+			ExpectCalls: []string{"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances"},
+			ExpectError: []string{"error_if_stop_required"},
+		},
+		{
+			Name:        "error_if_stop_required on t2.micro",
+			Fake:        testVolumeAttachmentFake{InstanceType: "t2.micro"},
+			Set:         map[string]interface{}{"error_if_stop_required": true},
+			ExpectCalls: []string{"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances"},
+			ExpectError: []string{"error_if_stop_required"},
+		},
+		{
+			// A Nitro instance can have the volume detached while it runs
+			Name:           "error_if_stop_required on m5.large",
+			Fake:           testVolumeAttachmentFake{InstanceType: "m5.large"},
+			Set:            map[string]interface{}{"error_if_stop_required": true},
+			ExpectCalls:    liveDetach,
+			ExpectInstance: "running",
+		},
+		{
+			Name:           "error_if_stop_required on c6g.xlarge",
+			Fake:           testVolumeAttachmentFake{InstanceType: "c6g.xlarge"},
+			Set:            map[string]interface{}{"error_if_stop_required": true},
+			ExpectCalls:    liveDetach,
+			ExpectInstance: "running",
+		},
+		{
+			// A Spot instance is never stopped
+			Name:           "spot instance",
+			Fake:           testVolumeAttachmentFake{Lifecycle: "spot"},
+			Set:            map[string]interface{}{"force_detach": true},
+			ExpectCalls:    liveDetach,
+			ExpectInstance: "running",
+		},
+		{
+			Name:        "skip_destroy",
+			Set:         map[string]interface{}{"skip_destroy": true},
+			ExpectCalls: []string{},
+		},
+		{
+			Name: "skip_destroy without stopping",
+			Set: map[string]interface{}{
+				"skip_destroy":                   true,
+				"stop_instance_before_detaching": false,
+			},
+			ExpectCalls: []string{},
+		},
+		{
+			Name:           "no stop",
+			Set:            map[string]interface{}{"stop_instance_before_detaching": false},
+			ExpectCalls:    []string{"DescribeVolumes", "DetachVolume", "DescribeVolumes"},
+			ExpectForced:   []bool{false},
+			ExpectInstance: "running",
+		},
+		{
+			Name: "no stop with force_detach",
+			Set: map[string]interface{}{
+				"stop_instance_before_detaching": false,
+				"force_detach":                   true,
+			},
+			ExpectCalls:    []string{"DescribeVolumes", "DetachVolume", "DescribeVolumes"},
+			ExpectForced:   []bool{true},
+			ExpectInstance: "running",
+		},
+		{
+			Name: "force_detach_after with a clean detach",
+			Set: map[string]interface{}{
+				"stop_instance_before_detaching": false,
+				"force_detach_after":             "50ms",
+			},
+			ExpectForced: []bool{false},
+		},
+		{
+			Name: "force_detach_after escalated",
+			Fake: testVolumeAttachmentFake{DetachesTo: "detaching"},
+			Set: map[string]interface{}{
+				"stop_instance_before_detaching": false,
+				"force_detach_after":             "50ms",
+			},
+			ExpectForced: []bool{false, true},
+		},
+		{
+			// Someone detached the volume by hand after it was read
+			Name:        "attachment not found",
+			Fake:        testVolumeAttachmentFake{Instance: "stopped", DetachedByHand: true},
+			ExpectCalls: liveDetach,
+		},
+		{
+			// The detach error is returned straight away rather than after
+			// a wait
+			Name: "volume not found on detach",
+			Fake: testVolumeAttachmentFake{
+				Errors: map[string][]string{"DetachVolume": {"InvalidVolume.NotFound"}},
+			},
+			Set:         map[string]interface{}{"stop_instance_before_detaching": false},
+			ExpectCalls: []string{"DescribeVolumes", "DetachVolume"},
+		},
+		{
+			Name: "detach error",
+			Fake: testVolumeAttachmentFake{
+				Errors: map[string][]string{"DetachVolume": {"UnauthorizedOperation"}},
+			},
+			Set:         map[string]interface{}{"stop_instance_before_detaching": false},
+			ExpectCalls: []string{"DescribeVolumes", "DetachVolume"},
+			ExpectError: []string{"UnauthorizedOperation", "req-1"},
+		},
+		{
+			Name:        "busy",
+			Fake:        testVolumeAttachmentFake{VolumeStates: []string{"attached", "detaching", "busy"}},
+			Set:         map[string]interface{}{"stop_instance_before_detaching": false},
+			ExpectCalls: []string{"DescribeVolumes", "DetachVolume", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes"},
+		},
+		{
+			Name:        "resume while detaching",
+			Fake:        testVolumeAttachmentFake{Volume: "detached", VolumeStates: []string{"detaching"}},
+			ExpectCalls: []string{"DescribeVolumes", "DescribeVolumes"},
+		},
+		{
+			Name:        "already detached",
+			Fake:        testVolumeAttachmentFake{Volume: "missing"},
+			ExpectCalls: []string{"DescribeVolumes"},
+		},
+
+		// The volume_attachment_count is that of the last refresh; a
+		// Multi-Attach volume whose peers have since detached was seen with
+		// more than one attachment.
+		{
+			Name: "last_attachment_behavior ignore",
+			Fake: testVolumeAttachmentFake{Instance: "stopped"},
+			Set: map[string]interface{}{
+				"last_attachment_behavior": "ignore",
+				"volume_attachment_count":  2,
+			},
+			ExpectCalls: liveDetach,
+		},
+		{
+			Name: "last_attachment_behavior error",
+			Fake: testVolumeAttachmentFake{Instance: "stopped"},
+			Set: map[string]interface{}{
+				"last_attachment_behavior": "error",
+				"volume_attachment_count":  2,
+			},
+			ExpectCalls: []string{"DescribeVolumes", "DescribeVolumes"},
+			ExpectError: []string{"last attachment"},
+		},
+		{
+			Name: "last_attachment_behavior error with another attachment",
+			Fake: testVolumeAttachmentFake{Instance: "stopped", OtherInstanceIDs: []string{"i-87654321"}},
+			Set: map[string]interface{}{
+				"last_attachment_behavior": "error",
+				"volume_attachment_count":  2,
+			},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeVolumes",
+				"DescribeInstances", "DetachVolume", "DescribeVolumes",
+			},
+		},
+		{
+			// A plain single-attach volume is destroyed as normal
+			Name: "last_attachment_behavior error with one attachment",
+			Fake: testVolumeAttachmentFake{Instance: "stopped"},
+			Set: map[string]interface{}{
+				"last_attachment_behavior": "error",
+				"volume_attachment_count":  1,
+			},
+			ExpectCalls: liveDetach,
+		},
+		{
+			Name: "last_attachment_behavior wait with one attachment",
+			Fake: testVolumeAttachmentFake{Instance: "stopped"},
+			Set: map[string]interface{}{
+				"last_attachment_behavior": "wait",
+				"volume_attachment_count":  1,
+			},
+			ExpectCalls: liveDetach,
+		},
+		{
+			Name: "last_attachment_behavior wait",
+			Fake: testVolumeAttachmentFake{Instance: "stopped"},
+			Set: map[string]interface{}{
+				"last_attachment_behavior": "wait",
+				"volume_attachment_count":  2,
+			},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeVolumes",
+				"DescribeInstances", "DetachVolume", "DescribeVolumes",
+				"DescribeVolumes",
+			},
+		},
+		{
+			Name: "Auto Scaling instance",
+			Fake: testVolumeAttachmentFake{AutoScaling: true},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances",
+				"DetachVolume", "DescribeVolumes",
+			},
+			ExpectInstance: "running",
+		},
+		{
+			Name:           "Auto Scaling instance with stop_autoscaling_instances",
+			Fake:           testVolumeAttachmentFake{AutoScaling: true},
+			Set:            map[string]interface{}{"stop_autoscaling_instances": true},
+			ExpectCalls:    append([]string{"DescribeVolumes", "DescribeInstances"}, stopAndRestart[3:]...),
+			ExpectInstance: "running",
+		},
+		{
+			// Without the permission the instance is treated as standalone
+			Name: "Auto Scaling access denied",
+			Fake: testVolumeAttachmentFake{
+				Errors: map[string][]string{"DescribeAutoScalingInstances": {"AccessDenied"}},
+			},
+			ExpectCalls:    stopAndRestart,
+			ExpectInstance: "running",
+		},
+	}
+
+	for _, tc := range cases {
+		fake := tc.Fake
+		client, calls := fake.client()
+
+		d := testVolumeAttachmentResourceData()
+		for k, v := range tc.Set {
+			d.Set(k, v)
+		}
+		err := resourceAwsVolumeAttachmentDelete(d, client)
+		if len(tc.ExpectError) > 0 {
+			if err == nil {
+				t.Fatalf("%s: expected error", tc.Name)
+			}
+			for _, expected := range tc.ExpectError {
+				if !strings.Contains(err.Error(), expected) {
+					t.Fatalf("%s: expected error to contain %q, got: %s", tc.Name, expected, err)
+				}
+			}
+			if d.Id() == "" {
+				t.Fatalf("%s: expected ID to be kept", tc.Name)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", tc.Name, err)
+			}
+			if d.Id() != "" {
+				t.Fatalf("%s: expected ID to be cleared, got %q", tc.Name, d.Id())
+			}
+		}
+
+		if tc.ExpectCalls != nil && !reflect.DeepEqual(*calls, tc.ExpectCalls) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.Name, tc.ExpectCalls, *calls)
+		}
+		if tc.ExpectForced != nil && !reflect.DeepEqual(fake.Forced, tc.ExpectForced) {
+			t.Fatalf("%s: expected DetachVolume with Force %v, got %v", tc.Name, tc.ExpectForced, fake.Forced)
+		}
+		if tc.ExpectInstance != "" && fake.Instance != tc.ExpectInstance {
+			t.Fatalf("%s: expected the instance to be %s, got %s", tc.Name, tc.ExpectInstance, fake.Instance)
+		}
+	}
+}
+
+// testVolumeAttachmentMoveClient fakes an instance and a volume attached to it
+// as *device, failing AttachVolume for any device in failDevices.
+func testVolumeAttachmentMoveClient(device *string, failDevices ...string) (*AWSClient, *[]string) {
+	instanceState := "running"
+	return testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			state := "attached"
+			if *device == "" {
+				state = "detached"
+			}
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", state)
+			if *device != "" {
+				out.Volumes[0].Attachments[0].Device = aws.String(*device)
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", instanceState)
+		case "StopInstances":
+			instanceState = "stopped"
+		case "StartInstances":
+			instanceState = "running"
+		case "DetachVolume":
+			if aws.BoolValue(r.Params.(*ec2.DetachVolumeInput).DryRun) {
+				r.Error = awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+				return
+			}
+			*device = ""
+		case "AttachVolume":
+			name := *r.Params.(*ec2.AttachVolumeInput).Device
+			for _, f := range failDevices {
+				if name == f {
+					r.Error = awserr.New("InvalidParameterValue", "Invalid value '"+name+"' for unixDevice", nil)
+					return
+				}
+			}
+			*device = name
+		}
+	})
+}
+
+func TestMoveVolumeAttachmentDevice(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	device := "/dev/sdh"
+	client, calls := testVolumeAttachmentMoveClient(&device)
+
+	d := testVolumeAttachmentResourceData()
+	err := moveVolumeAttachmentDevice(newInstrumentedEC2Conn(client), client.autoscalingconn, d, "/dev/sdh", "/dev/sdi")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer volumeAttachmentDevices.release("i-12345678", "/dev/sdi", "vol-12345678")
+
+	if device != "/dev/sdi" {
+		t.Fatalf("expected the volume to be attached as /dev/sdi, got %q", device)
+	}
+	// The new attachment is confirmed attach_confirmations times, as for Create
+	expected := []string{
+		"DescribeInstances", "DescribeAutoScalingInstances", "StopInstances", "DescribeInstances",
+		"DetachVolume", "DescribeVolumes", "AttachVolume", "DescribeVolumes", "DescribeVolumes",
+		"StartInstances", "DescribeInstances",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+}
+
+func TestMoveVolumeAttachmentDevice_attachFails(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	device := "/dev/sdh"
+	client, calls := testVolumeAttachmentMoveClient(&device, "/dev/sdi")
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("stop_instance_before_detaching", false)
+	err := moveVolumeAttachmentDevice(newInstrumentedEC2Conn(client), client.autoscalingconn, d, "/dev/sdh", "/dev/sdi")
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The volume is put back where it was rather than left detached
+	if device != "/dev/sdh" {
+		t.Fatalf("expected the volume to be attached as /dev/sdh again, got %q", device)
+	}
+	expected := []string{
+		"DetachVolume", "DescribeVolumes", "AttachVolume", "AttachVolume", "DescribeVolumes", "DescribeVolumes",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if err := volumeAttachmentDevices.claim("i-12345678", "/dev/sdi", "vol-87654321"); err != nil {
+		t.Fatalf("expected /dev/sdi to be released: %s", err)
+	}
+	volumeAttachmentDevices.release("i-12345678", "/dev/sdi", "vol-87654321")
+}
+
+func TestMoveVolumeAttachmentDevice_guards(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Name     string
+		Set      map[string]interface{}
+		Expected []string
+	}{
+		{
+			Name:     "root device",
+			Set:      map[string]interface{}{"is_root_device": true},
+			Expected: []string{},
+		},
+		{
+			Name:     "dry run",
+			Set:      map[string]interface{}{"dry_run": true},
+			Expected: []string{"DetachVolume"},
+		},
+		{
+			Name:     "skip_destroy",
+			Set:      map[string]interface{}{"skip_destroy": true},
+			Expected: []string{},
+		},
+		{
+			Name:     "manage_lifecycle_only",
+			Set:      map[string]interface{}{"manage_lifecycle_only": true},
+			Expected: []string{},
+		},
+	}
+
+	for _, tc := range cases {
+		device := "/dev/sdh"
+		client, calls := testVolumeAttachmentMoveClient(&device)
+
+		d := testVolumeAttachmentResourceData()
+		for k, v := range tc.Set {
+			d.Set(k, v)
+		}
+		err := moveVolumeAttachmentDevice(newInstrumentedEC2Conn(client), client.autoscalingconn, d, "/dev/sdh", "/dev/sdi")
+		if err == nil {
+			t.Fatalf("%s: expected error", tc.Name)
+		}
+
+		if device != "/dev/sdh" {
+			t.Fatalf("%s: expected the volume to stay attached as /dev/sdh, got %q", tc.Name, device)
+		}
+		if !reflect.DeepEqual(*calls, tc.Expected) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.Name, tc.Expected, *calls)
+		}
+	}
+}
+
+func TestMoveVolumeAttachmentDevice_detachTimeoutBehaviorNoStop(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	device := "/dev/sdh"
+	client, calls := testVolumeAttachmentMoveClient(&device)
+
+	// As for a destroy, "continue" never stops the instance
+	d := testVolumeAttachmentResourceData()
+	d.Set("detach_timeout_behavior", "continue")
+	err := moveVolumeAttachmentDevice(newInstrumentedEC2Conn(client), client.autoscalingconn, d, "/dev/sdh", "/dev/sdi")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer volumeAttachmentDevices.release("i-12345678", "/dev/sdi", "vol-12345678")
+
+	expected := []string{
+		"DetachVolume", "DescribeVolumes", "AttachVolume", "DescribeVolumes", "DescribeVolumes",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_restartOnError(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Name string
+		Set  string
+		// Fail is the call that fails. DescribeVolumes only fails once
+		// the volume has been detached, with Filtered telling the detach
+		// wait apart from the other waits.
+		Fail     string
+		Filtered bool
+	}{
+		{Name: "snapshot", Set: "snapshot_before_detach", Fail: "CreateSnapshot"},
+		{Name: "detach wait", Fail: "DescribeVolumes", Filtered: true},
+		{Name: "cleanup wait", Set: "wait_for_attachment_cleanup", Fail: "DescribeVolumes"},
+		{Name: "available wait", Set: "wait_for_available", Fail: "DescribeVolumes"},
+	}
+
+	for _, tc := range cases {
+		detached := false
+		instanceState := "running"
+		client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				filtered := len(r.Params.(*ec2.DescribeVolumesInput).Filters) > 0
+				if tc.Fail == "DescribeVolumes" && detached && filtered == tc.Filtered {
+					r.Error = awserr.New("UnauthorizedOperation", "not allowed", nil)
+					return
+				}
+				state := "attached"
+				if detached {
+					state = "detached"
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			case "DescribeInstances":
+				*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+					"i-12345678", instanceState)
+			case "StopInstances":
+				instanceState = "stopped"
+			case "StartInstances":
+				instanceState = "running"
+			case "DetachVolume":
+				detached = true
+			case tc.Fail:
+				r.Error = awserr.New("UnauthorizedOperation", "not allowed", nil)
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		if tc.Set != "" {
+			d.Set(tc.Set, true)
+		}
+		if err := resourceAwsVolumeAttachmentDelete(d, client); err == nil {
+			t.Fatalf("%s: expected error", tc.Name)
+		}
+
+		// The instance is started again rather than left stopped
+		if instanceState != "running" {
+			t.Fatalf("%s: expected instance to be running again, got %q after calls %v", tc.Name, instanceState, *calls)
+		}
+		if d.Id() == "" {
+			t.Fatalf("%s: expected ID to be kept", tc.Name)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_stopTimeout(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	instanceState := "running"
+	client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "attached")
+		case "DescribeInstances":
+			out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", instanceState)
+			out.Reservations[0].Instances[0].StateReason = &ec2.StateReason{
+				Code:    aws.String("Client.UserInitiatedShutdown"),
+				Message: aws.String("Client.UserInitiatedShutdown: User initiated shutdown"),
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = out
+		case "StopInstances":
+			// The instance never gets past stopping
+			instanceState = "stopping"
+		case "DetachVolume":
+			t.Fatalf("expected the volume not to be detached")
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("timeouts", []interface{}{map[string]interface{}{"delete": "10ms"}})
+
+	err := resourceAwsVolumeAttachmentDelete(d, client)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	expected := "instance i-12345678 stuck in stopping; reason: Client.UserInitiatedShutdown"
+	if !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected error to contain %q, got: %s", expected, err)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_preDetachGrace(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	var events []string
+	defer func(sleep func(time.Duration)) { volumeAttachmentSleep = sleep }(volumeAttachmentSleep)
+	volumeAttachmentSleep = func(d time.Duration) {
+		events = append(events, fmt.Sprintf("sleep %s", d))
+	}
+
+	instanceState := "running"
+	detached := false
+	client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			state := "attached"
+			if detached {
+				state = "detached"
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", state)
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", instanceState)
+		case "StopInstances", "StartInstances", "DetachVolume":
+			events = append(events, r.Operation.Name)
+			switch r.Operation.Name {
+			case "StopInstances":
+				instanceState = "stopped"
+			case "StartInstances":
+				instanceState = "running"
+			case "DetachVolume":
+				detached = true
+			}
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("pre_detach_grace_seconds", 30)
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{"StopInstances", "sleep 30s", "DetachVolume", "StartInstances"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+}
+
+func TestResourceAwsVolumeAttachment_manageInstancePower(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	for _, detachErr := range []bool{false, true} {
+		detached := false
+		client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				state := "attached"
+				if detached {
+					state = "detached"
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			case "DescribeInstances":
+				*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+					"i-12345678", "stopped")
+			case "StopInstances", "StartInstances":
+				t.Fatalf("expected %s not to be called", r.Operation.Name)
+			case "DetachVolume":
+				if detachErr {
+					r.Error = awserr.New("OperationNotPermitted", "The volume cannot be detached while the instance is running", nil)
+					return
+				}
+				detached = true
+			}
+		})
+
+		// Destroy goes straight to the detach
+		d := testVolumeAttachmentResourceData()
+		d.Set("manage_instance_power", false)
+		d.Set("force_detach", true)
+		err := resourceAwsVolumeAttachmentDelete(d, client)
+		if detachErr {
+			if err == nil || !strings.Contains(err.Error(), "manage_instance_power is false") {
+				t.Fatalf("expected a detach error naming manage_instance_power, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expected := []string{"DescribeVolumes", "DetachVolume", "DescribeVolumes"}
+		if !reflect.DeepEqual(*calls, expected) {
+			t.Fatalf("expected calls %v, got %v", expected, *calls)
+		}
+		if d.Get("will_stop_instance_on_destroy").(bool) || volumeAttachmentStopsInstanceOnDestroy(d) {
+			t.Fatalf("expected the instance not to be stopped on destroy")
+		}
+
+		// A stopped instance isn't started after the attach either
+		d = testVolumeAttachmentResourceData()
+		d.SetId("")
+		d.Set("manage_instance_power", false)
+		d.Set("start_instance_after_attach", true)
+		if err := startVolumeAttachmentInstanceAfterAttach(newInstrumentedEC2Conn(client), d); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_retryDetach(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Code string
+		// Whether the volume has in fact detached when the error is returned
+		Detached    bool
+		ExpectCalls []string
+	}{
+		{
+			Code: "VolumeInUse",
+			ExpectCalls: []string{
+				"DescribeVolumes", "DetachVolume", "DetachVolume", "DescribeVolumes",
+			},
+		},
+		{
+			Code: "IncorrectState",
+			ExpectCalls: []string{
+				"DescribeVolumes", "DetachVolume", "DescribeVolumes", "DetachVolume", "DescribeVolumes",
+			},
+		},
+		{
+			Code:     "IncorrectState",
+			Detached: true,
+			ExpectCalls: []string{
+				"DescribeVolumes", "DetachVolume", "DescribeVolumes", "DescribeVolumes",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		attempts := 0
+		detached := false
+		conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				state := "attached"
+				if detached {
+					state = "detached"
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			case "DetachVolume":
+				attempts++
+				if !*r.Params.(*ec2.DetachVolumeInput).Force {
+					t.Fatalf("%s: expected every attempt to be forced", tc.Code)
+				}
+				if attempts == 1 {
+					r.Error = awserr.New(tc.Code, "vol-12345678 is busy", nil)
+					detached = tc.Detached
+					return
+				}
+				detached = true
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("stop_instance_before_detaching", false)
+		d.Set("force_detach", true)
+		if err := resourceAwsVolumeAttachmentDelete(d, &AWSClient{ec2conn: conn}); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Code, err)
+		}
+		if !reflect.DeepEqual(*calls, tc.ExpectCalls) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.Code, tc.ExpectCalls, *calls)
+		}
+		if d.Id() != "" {
+			t.Fatalf("%s: expected ID to be cleared, got %q", tc.Code, d.Id())
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_snapshotBeforeDetach(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	detached := false
+	var snapshotVolume string
+	var snapshotTags []*ec2.Tag
+	conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			state := "attached"
+			if detached {
+				state = "detached"
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", state)
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "stopped")
+		case "CreateSnapshot":
+			snapshotVolume = *r.Params.(*ec2.CreateSnapshotInput).VolumeId
+			*r.Data.(*ec2.Snapshot) = ec2.Snapshot{SnapshotId: aws.String("snap-12345678")}
+		case "CreateTags":
+			snapshotTags = r.Params.(*ec2.CreateTagsInput).Tags
+		case "DescribeSnapshots":
+			*r.Data.(*ec2.DescribeSnapshotsOutput) = ec2.DescribeSnapshotsOutput{
+				Snapshots: []*ec2.Snapshot{
+					{SnapshotId: aws.String("snap-12345678"), State: aws.String("pending")},
+				},
+			}
+		case "DetachVolume":
+			detached = true
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("snapshot_before_detach", true)
+	if err := resourceAwsVolumeAttachmentDelete(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"DescribeVolumes", "DescribeInstances",
+		"CreateSnapshot", "CreateTags", "DescribeSnapshots",
+		"DetachVolume", "DescribeVolumes",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if snapshotVolume != "vol-12345678" {
+		t.Fatalf("expected snapshot of vol-12345678, got %q", snapshotVolume)
+	}
+	if len(snapshotTags) != 2 {
+		t.Fatalf("expected snapshot to be tagged with instance and device, got %v", snapshotTags)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_liveDevice(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		// The device the volume is attached as in AWS
+		Device       *string
+		ExpectDevice *string
+	}{
+		{Device: aws.String("/dev/sdh"), ExpectDevice: aws.String("/dev/sdh")},
+		{Device: aws.String("/dev/sdf"), ExpectDevice: aws.String("/dev/sdf")},
+		{Device: nil, ExpectDevice: nil},
+	}
+
+	for _, tc := range cases {
+		detached := false
+		var detachInput *ec2.DetachVolumeInput
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				state := "attached"
+				if detached {
+					state = "detached"
+				}
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", state)
+				if !detached {
+					out.Volumes[0].Attachments[0].Device = tc.Device
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "DetachVolume":
+				detachInput = r.Params.(*ec2.DetachVolumeInput)
+				detached = true
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("stop_instance_before_detaching", false)
+		if err := resourceAwsVolumeAttachmentDelete(d, &AWSClient{ec2conn: conn}); err != nil {
+			t.Fatalf("%v: unexpected error: %s", aws.StringValue(tc.Device), err)
+		}
+		if !reflect.DeepEqual(detachInput.Device, tc.ExpectDevice) {
+			t.Fatalf("%v: expected DetachVolume device %v, got %v", aws.StringValue(tc.Device),
+				aws.StringValue(tc.ExpectDevice), aws.StringValue(detachInput.Device))
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_manageLifecycleOnly(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Field       string
+		ExpectCalls []string
+	}{
+		{
+			// skip_destroy only affects destroy, but an existing attachment
+			// to the same instance is never attached again
+			Field: "skip_destroy",
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes",
+				"DescribeInstances",
+			},
+		},
+		{
+			// manage_lifecycle_only adopts the existing attachment
+			Field: "manage_lifecycle_only",
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes",
+				"DescribeInstances",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", "attached")
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		d.Set(tc.Field, true)
+		if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Field, err)
+		}
+		if !reflect.DeepEqual(*calls, tc.ExpectCalls) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.Field, tc.ExpectCalls, *calls)
+		}
+		if d.Id() == "" {
+			t.Fatalf("%s: expected ID to be set", tc.Field)
+		}
+
+		// Both leave the volume attached on destroy
+		*calls = []string{}
+		if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Field, err)
+		}
+		if len(*calls) != 0 {
+			t.Fatalf("%s: expected no calls on destroy, got %v", tc.Field, *calls)
+		}
+	}
+}
+
+// TestResourceAwsVolumeAttachmentCreate runs Create against the fake EC2 for
+// each setting and instance or volume state that changes the calls it makes.
+func TestResourceAwsVolumeAttachmentCreate(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Name        string
+		Fake        testVolumeAttachmentFake
+		Set         map[string]interface{}
+		ExpectCalls []string
+		// ExpectError lists what the error must contain, if one is expected
+		ExpectError []string
+		// ExpectInstance is the state the instance is left in, if set
+		ExpectInstance string
+	}{
+		{
+			Name: "retry VolumeInUse",
+			Fake: testVolumeAttachmentFake{
+				Volume: "detached",
+				Errors: map[string][]string{"AttachVolume": {"VolumeInUse"}},
+			},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume", "AttachVolume",
+				"DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+				"DescribeAutoScalingInstances",
+			},
+		},
+		{
+			Name: "retry IncorrectState",
+			Fake: testVolumeAttachmentFake{
+				Volume: "detached",
+				Errors: map[string][]string{"AttachVolume": {"IncorrectState", "IncorrectState"}},
+			},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume", "AttachVolume",
+				"AttachVolume", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+				"DescribeAutoScalingInstances",
+			},
+		},
+		{
+			Name: "attach error not retried",
+			Fake: testVolumeAttachmentFake{
+				Volume: "detached",
+				Errors: map[string][]string{"AttachVolume": {"InvalidVolume.ZoneMismatch"}},
+			},
+			ExpectCalls: []string{"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume"},
+			ExpectError: []string{"InvalidVolume.ZoneMismatch"},
+		},
+		{
+			// The volume must be available before it is attached
+			Name: "wait for volume available",
+			Fake: testVolumeAttachmentFake{Volume: "detached", VolumeStates: []string{"creating", "creating"}},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances", "DescribeVolumes",
+				"AttachVolume", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+				"DescribeAutoScalingInstances",
+			},
+		},
+		{
+			// The instance must be running before the volume is attached
+			Name: "wait for instance",
+			Fake: testVolumeAttachmentFake{Volume: "detached", InstanceStates: []string{"pending", "pending"}},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeInstances", "DescribeInstances", "DescribeVolumes",
+				"AttachVolume", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+				"DescribeAutoScalingInstances",
+			},
+		},
+		{
+			// An existing attachment is never attached again
+			Name: "already attached",
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes",
+				"DescribeInstances", "DescribeAutoScalingInstances",
+			},
+		},
+		{
+			// The instance is only started once the volume is attached
+			Name: "start_instance_after_attach on a stopped instance",
+			Fake: testVolumeAttachmentFake{Volume: "detached", Instance: "stopped"},
+			Set:  map[string]interface{}{"start_instance_after_attach": true},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume", "DescribeVolumes",
+				"DescribeVolumes", "DescribeInstances", "StartInstances", "DescribeInstances",
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances",
+			},
+			ExpectInstance: "running",
+		},
+		{
+			// The running instance would be stopped on destroy, unless it
+			// is in an Auto Scaling group
+			Name: "start_instance_after_attach on a running instance",
+			Fake: testVolumeAttachmentFake{Volume: "detached"},
+			Set:  map[string]interface{}{"start_instance_after_attach": true},
+			ExpectCalls: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume", "DescribeVolumes",
+				"DescribeVolumes", "DescribeInstances",
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances",
+			},
+			ExpectInstance: "running",
+		},
+	}
+
+	for _, tc := range cases {
+		fake := tc.Fake
+		client, calls := fake.client()
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		for k, v := range tc.Set {
+			d.Set(k, v)
+		}
+		err := resourceAwsVolumeAttachmentCreate(d, client)
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+		if len(tc.ExpectError) > 0 {
+			if err == nil {
+				t.Fatalf("%s: expected error", tc.Name)
+			}
+			for _, expected := range tc.ExpectError {
+				if !strings.Contains(err.Error(), expected) {
+					t.Fatalf("%s: expected error to contain %q, got: %s", tc.Name, expected, err)
+				}
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", tc.Name, err)
+			}
+			if d.Id() == "" {
+				t.Fatalf("%s: expected ID to be set", tc.Name)
+			}
+		}
+
+		if !reflect.DeepEqual(*calls, tc.ExpectCalls) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.Name, tc.ExpectCalls, *calls)
+		}
+		if tc.ExpectInstance != "" && fake.Instance != tc.ExpectInstance {
+			t.Fatalf("%s: expected the instance to be %s, got %s", tc.Name, tc.ExpectInstance, fake.Instance)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_notFoundChecks(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Empties     int
+		ExpectError bool
+	}{
+		// Within attach_not_found_checks, the empty reads are retried
+		{Empties: 2},
+		{Empties: 3, ExpectError: true},
+	}
+
+	for _, tc := range cases {
+		attached := false
+		empties := 0
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "AttachVolume":
+				attached = true
+			case "DescribeVolumes":
+				if attached && empties < tc.Empties {
+					// The new attachment isn't visible yet
+					empties++
+					return
+				}
+				state := "detached"
+				if attached {
+					state = "attached"
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		d.Set("attach_not_found_checks", 2)
+		err := resourceAwsVolumeAttachmentCreate(d, client)
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+		if tc.ExpectError {
+			if err == nil || !strings.Contains(err.Error(), "couldn't find") {
+				t.Fatalf("%d empty reads: expected a not found error, got %v", tc.Empties, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d empty reads: unexpected error: %s", tc.Empties, err)
+		}
+	}
+}
+
+func TestWaitForVolumeAttachmentSnapshotInit(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	for _, snapshotID := range []string{"snap-12345678", ""} {
+		statuses := []string{"insufficient-data", "insufficient-data", "ok"}
+		conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "detached")
+				if snapshotID != "" {
+					out.Volumes[0].SnapshotId = aws.String(snapshotID)
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "DescribeVolumeStatus":
+				*r.Data.(*ec2.DescribeVolumeStatusOutput) = ec2.DescribeVolumeStatusOutput{
+					VolumeStatuses: []*ec2.VolumeStatusItem{
+						{
+							VolumeId:     aws.String("vol-12345678"),
+							VolumeStatus: &ec2.VolumeStatusInfo{Status: aws.String(statuses[0])},
+						},
+					},
+				}
+				statuses = statuses[1:]
+			}
+		})
+
+		err := waitForVolumeAttachmentSnapshotInit(newInstrumentedEC2Conn(&AWSClient{ec2conn: conn}), "vai-12345678",
+			"vol-12345678", time.Minute, 0, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", snapshotID, err)
+		}
+
+		expected := []string{"DescribeVolumes"}
+		if snapshotID != "" {
+			expected = append(expected, "DescribeVolumeStatus", "DescribeVolumeStatus", "DescribeVolumeStatus")
+		}
+		if !reflect.DeepEqual(*calls, expected) {
+			t.Fatalf("%q: expected calls %v, got %v", snapshotID, expected, *calls)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachment_volumeGone(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	for _, op := range []string{"create", "delete"} {
+		gone := false
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				if gone {
+					r.Error = awserr.New("InvalidVolume.NotFound", "The volume 'vol-12345678' does not exist.", nil)
+					return
+				}
+				state := "detached"
+				if op == "delete" {
+					state = "attached"
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			case "AttachVolume", "DetachVolume":
+				// Deleted out of band as soon as it is (de)attached
+				gone = true
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("stop_instance_before_detaching", false)
+		if op == "delete" {
+			if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+				t.Fatalf("delete: unexpected error: %s", err)
+			}
+			if d.Id() != "" {
+				t.Fatalf("delete: expected ID to be cleared, got %q", d.Id())
+			}
+			continue
+		}
+
+		d.SetId("")
+		err := resourceAwsVolumeAttachmentCreate(d, client)
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+		if err == nil || !strings.Contains(err.Error(), "volume vol-12345678 disappeared during attach") {
+			t.Fatalf("create: expected a disappeared volume error, got %v", err)
+		}
+		if d.Id() != "" {
+			t.Fatalf("create: expected no ID to be set, got %q", d.Id())
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_attachConfirmations(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Confirmations int
+		ExpectedReads int
+	}{
+		// A single "attached" read is trusted even though it flaps back
+		{Confirmations: 1, ExpectedReads: 1},
+		// The flap resets the count, so two more reads are needed after it
+		{Confirmations: 2, ExpectedReads: 4},
+	}
+
+	for _, tc := range cases {
+		attached := false
+		states := []string{"attached", "attaching", "attached", "attached"}
+		reads := 0
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "AttachVolume":
+				attached = true
+			case "DescribeVolumes":
+				state := "detached"
+				if attached {
+					state = "attached"
+					if reads < len(states) {
+						state = states[reads]
+					}
+					reads++
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		d.Set("attach_confirmations", tc.Confirmations)
+		err := resourceAwsVolumeAttachmentCreate(d, client)
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+		if err != nil {
+			t.Fatalf("%d confirmations: unexpected error: %s", tc.Confirmations, err)
+		}
+		// Read makes one more DescribeVolumes call after the wait
+		if reads-1 != tc.ExpectedReads {
+			t.Fatalf("%d confirmations: expected the wait to read the attachment %d times, got %d",
+				tc.Confirmations, tc.ExpectedReads, reads-1)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_launchMapping(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	launched := time.Date(2016, 12, 1, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Name       string
+		AttachTime time.Time
+		ExpectWarn bool
+	}{
+		{Name: "launch-time mapping", AttachTime: launched.Add(5 * time.Second), ExpectWarn: true},
+		{Name: "attached later", AttachTime: launched.Add(time.Hour)},
+	}
+
+	for _, tc := range cases {
+		client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "AttachVolume":
+				t.Fatalf("%s: expected an existing attachment not to be attached again", tc.Name)
+			case "DescribeVolumes":
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", "attached")
+			case "DescribeInstances":
+				out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "stopped")
+				out.Reservations[0].Instances[0].LaunchTime = aws.Time(launched)
+				out.Reservations[0].Instances[0].BlockDeviceMappings = []*ec2.InstanceBlockDeviceMapping{
+					{
+						DeviceName: aws.String("/dev/sdh"),
+						Ebs: &ec2.EbsInstanceBlockDevice{
+							VolumeId:   aws.String("vol-12345678"),
+							AttachTime: aws.Time(tc.AttachTime),
+						},
+					},
+				}
+				*r.Data.(*ec2.DescribeInstancesOutput) = out
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		err := resourceAwsVolumeAttachmentCreate(d, client)
+		log.SetOutput(os.Stderr)
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Name, err)
+		}
+
+		if warned := strings.Contains(buf.String(), "since the instance was launched"); warned != tc.ExpectWarn {
+			t.Fatalf("%s: expected a launch-time mapping warning: %t, got %t", tc.Name, tc.ExpectWarn, warned)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_alreadyAttachedAsOtherDevice(t *testing.T) {
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		if r.Operation.Name == "DescribeVolumes" {
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+			out.Volumes[0].Attachments[0].Device = aws.String("/dev/sdf")
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	err := resourceAwsVolumeAttachmentCreate(d, client)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	expected := "Volume (vol-12345678) is already attached to Instance (i-12345678) as /dev/sdf rather than /dev/sdh"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q, got %q", expected, err)
+	}
+	if !reflect.DeepEqual(*calls, []string{"DescribeVolumes"}) {
+		t.Fatalf("expected the volume not to be attached, got %v", *calls)
+	}
+	if err := volumeAttachmentDevices.claim("i-12345678", "/dev/sdh", "vol-87654321"); err != nil {
+		t.Fatalf("expected the device to be released: %s", err)
+	}
+	volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-87654321")
+}
+
+func TestResourceAwsVolumeAttachmentDelete_deviceClaim(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Name        string
+		Set         map[string]interface{}
+		DetachError string
+		// AfterDetach is the state the volume is left in by DetachVolume
+		AfterDetach string
+		ExpectError bool
+		ExpectClaim bool
+	}{
+		{Name: "detached", AfterDetach: "detached"},
+		{Name: "skip_destroy", Set: map[string]interface{}{"skip_destroy": true}, AfterDetach: "attached"},
+		{
+			Name: "detach error", DetachError: "UnauthorizedOperation", AfterDetach: "attached",
+			ExpectError: true, ExpectClaim: true,
+		},
+		{
+			// The volume may still be on the device
+			Name: "continue", AfterDetach: "detaching", ExpectClaim: true,
+			Set: map[string]interface{}{
+				"detach_timeout_behavior": "continue",
+				"timeouts":                []interface{}{map[string]interface{}{"delete": "10ms"}},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		detached := false
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				state := "attached"
+				if detached {
+					state = tc.AfterDetach
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", state)
+			case "DetachVolume":
+				if tc.DetachError != "" {
+					r.Error = awserr.New(tc.DetachError, "detach failed", nil)
+					return
+				}
+				detached = true
+			}
+		})
+
+		if err := volumeAttachmentDevices.claim("i-12345678", "/dev/sdh", "vol-12345678"); err != nil {
+			t.Fatalf("%s: %s", tc.Name, err)
+		}
+		d := testVolumeAttachmentResourceData()
+		d.Set("stop_instance_before_detaching", false)
+		for k, v := range tc.Set {
+			d.Set(k, v)
+		}
+		err := resourceAwsVolumeAttachmentDelete(d, &AWSClient{ec2conn: conn})
+		if tc.ExpectError != (err != nil) {
+			t.Fatalf("%s: expected error %t, got %v", tc.Name, tc.ExpectError, err)
+		}
+
+		// Another volume can only claim the device once it has been released
+		err = volumeAttachmentDevices.claim("i-12345678", "/dev/sdh", "vol-87654321")
+		if tc.ExpectClaim != (err != nil) {
+			t.Fatalf("%s: expected the device to be claimed %t, got %v", tc.Name, tc.ExpectClaim, err)
+		}
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-87654321")
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_instanceTagName(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	var filters []*ec2.Filter
+	attached := false
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeInstances":
+			if f := r.Params.(*ec2.DescribeInstancesInput).Filters; f != nil {
+				filters = f
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "running")
+		case "AttachVolume":
+			if id := *r.Params.(*ec2.AttachVolumeInput).InstanceId; id != "i-12345678" {
+				t.Fatalf("expected attach to i-12345678, got %s", id)
+			}
+			attached = true
+		case "DescribeVolumes":
+			state := "detached"
+			if attached {
+				state = "attached"
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", state)
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.Set("device_name", "/dev/sdh")
+	d.Set("volume_id", "vol-12345678")
+	d.Set("instance_tag_name", "web")
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+
+	expected := []string{
+		"DescribeInstances", "DescribeVolumes", "DescribeInstances", "DescribeVolumes",
+		"AttachVolume", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if len(filters) == 0 || *filters[0].Name != "tag:Name" || *filters[0].Values[0] != "web" {
+		t.Fatalf("expected a tag:Name filter, got %v", filters)
+	}
+	if id := d.Get("instance_id").(string); id != "i-12345678" {
+		t.Fatalf("expected instance_id to be i-12345678, got %q", id)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_volumeTagName(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	var filters []*ec2.Filter
+	attached := false
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "running")
+		case "AttachVolume":
+			if id := *r.Params.(*ec2.AttachVolumeInput).VolumeId; id != "vol-12345678" {
+				t.Fatalf("expected attach of vol-12345678, got %s", id)
+			}
+			attached = true
+		case "DescribeVolumes":
+			if f := r.Params.(*ec2.DescribeVolumesInput).Filters; f != nil && *f[0].Name == "tag:Name" {
+				filters = f
+			}
+			state := "detached"
+			if attached {
+				state = "attached"
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", state)
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.Set("device_name", "/dev/sdh")
+	d.Set("instance_id", "i-12345678")
+	d.Set("volume_tag_name", "data")
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+
+	expected := []string{
+		"DescribeVolumes", "DescribeVolumes", "DescribeInstances", "DescribeVolumes",
+		"AttachVolume", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if len(filters) == 0 || *filters[0].Values[0] != "data" {
+		t.Fatalf("expected a tag:Name filter, got %v", filters)
+	}
+	if id := d.Get("volume_id").(string); id != "vol-12345678" {
+		t.Fatalf("expected volume_id to be vol-12345678, got %q", id)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_waitFailsReleasesDevice(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	attached := false
+	client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			if attached {
+				// Deleted out of band as soon as it is attached
+				r.Error = awserr.New("InvalidVolume.NotFound", "The volume 'vol-12345678' does not exist.", nil)
+				return
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "detached")
+		case "AttachVolume":
+			attached = true
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The failed attachment no longer holds the device
+	if err := volumeAttachmentDevices.claim("i-12345678", "/dev/sdh", "vol-87654321"); err != nil {
+		t.Fatalf("expected the device to be released, got %s", err)
+	}
+	volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-87654321")
+}
+
+func TestVerifyVolumeAttachmentEbsOptimized(t *testing.T) {
+	cases := []struct {
+		VolumeType  string
+		ExpectCalls []string
+		ExpectWarn  bool
+	}{
+		{
+			VolumeType:  "io1",
+			ExpectCalls: []string{"DescribeVolumes", "DescribeInstances"},
+			ExpectWarn:  true,
+		},
+		{
+			// Only volumes with provisioned performance are checked
+			VolumeType:  "gp2",
+			ExpectCalls: []string{"DescribeVolumes"},
+		},
+	}
+
+	for _, tc := range cases {
+		conn, calls := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "detached")
+				out.Volumes[0].VolumeType = aws.String(tc.VolumeType)
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "DescribeInstances":
+				out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+				out.Reservations[0].Instances[0].EbsOptimized = aws.Bool(false)
+				*r.Data.(*ec2.DescribeInstancesOutput) = out
+			}
+		})
+
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		err := verifyVolumeAttachmentEbsOptimized(newInstrumentedEC2Conn(&AWSClient{ec2conn: conn}), "vai-12345678", "vol-12345678", "i-12345678")
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.VolumeType, err)
+		}
+
+		if !reflect.DeepEqual(*calls, tc.ExpectCalls) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.VolumeType, tc.ExpectCalls, *calls)
+		}
+		if warned := strings.Contains(buf.String(), "[WARN]") && strings.Contains(buf.String(), "not EBS-optimized"); warned != tc.ExpectWarn {
+			t.Fatalf("%s: expected a warning to be logged: %t, got log %q", tc.VolumeType, tc.ExpectWarn, buf.String())
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_deviceInUse(t *testing.T) {
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		if r.Operation.Name == "DescribeInstances" {
+			out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+			out.Reservations[0].Instances[0].BlockDeviceMappings = []*ec2.InstanceBlockDeviceMapping{
+				{
+					DeviceName: aws.String("/dev/xvdh"),
+					Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-87654321")},
+				},
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = out
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	err := resourceAwsVolumeAttachmentCreate(d, client)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	expected := "device /dev/sdh is already in use by volume vol-87654321 on instance i-12345678"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q, got %q", expected, err)
+	}
+	if !reflect.DeepEqual(*calls, []string{"DescribeVolumes", "DescribeInstances", "DescribeVolumes"}) {
+		t.Fatalf("expected the volume not to be attached, got %v", *calls)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_availabilityZoneMismatch(t *testing.T) {
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeInstances":
+			out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+			out.Reservations[0].Instances[0].Placement = &ec2.Placement{AvailabilityZone: aws.String("us-east-1b")}
+			*r.Data.(*ec2.DescribeInstancesOutput) = out
+		case "DescribeVolumes":
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "detached")
+			out.Volumes[0].AvailabilityZone = aws.String("us-east-1a")
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	err := resourceAwsVolumeAttachmentCreate(d, client)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	expected := "volume vol-12345678 is in us-east-1a but instance i-12345678 is in us-east-1b"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q, got %q", expected, err)
+	}
+	if !reflect.DeepEqual(*calls, []string{"DescribeVolumes", "DescribeInstances", "DescribeVolumes"}) {
+		t.Fatalf("expected the volume not to be attached, got %v", *calls)
+	}
+}
+
+func TestVolumeAttachmentInLaunchMapping(t *testing.T) {
+	launched := time.Date(2016, 12, 1, 10, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		Device     string
+		VolumeID   string
+		AttachTime time.Time
+		Expected   bool
+	}{
+		{"/dev/sdh", "vol-12345678", launched.Add(5 * time.Second), true},
+		{"/dev/xvdh", "vol-12345678", launched.Add(-time.Hour), true},
+		{"/dev/sdh", "vol-12345678", launched.Add(time.Hour), false},
+		{"/dev/sdh", "vol-87654321", launched, false},
+		{"/dev/sdf", "vol-12345678", launched, false},
+	}
+
+	for _, tc := range cases {
+		instance := &ec2.Instance{
+			LaunchTime: aws.Time(launched),
+			BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{
+				{
+					DeviceName: aws.String(tc.Device),
+					Ebs: &ec2.EbsInstanceBlockDevice{
+						VolumeId:   aws.String(tc.VolumeID),
+						AttachTime: aws.Time(tc.AttachTime),
+					},
+				},
+			},
+		}
+		if got := volumeAttachmentInLaunchMapping(instance, "/dev/sdh", "vol-12345678"); got != tc.Expected {
+			t.Fatalf("%s %s attached at %s: expected %t, got %t",
+				tc.Device, tc.VolumeID, tc.AttachTime, tc.Expected, got)
+		}
+	}
+}
+
+func TestCheckVolumeAttachmentPlatformDeviceName(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Platform    string
+		ExpectError bool
+	}{
+		{Name: "/dev/sdf", Platform: ""},
+		{Name: "/dev/xvdf", Platform: ""},
+		{Name: "xvdf", Platform: "", ExpectError: true},
+		{Name: "xvdf", Platform: "windows"},
+		{Name: "/dev/sdf", Platform: "windows", ExpectError: true},
+		{Name: "/dev/xvdf", Platform: "windows", ExpectError: true},
+		{Name: "/dev/sdb", Platform: "windows"},
+		{Name: "/dev/sde", Platform: "windows"},
+		{Name: "/dev/sda1", Platform: "windows"},
+	}
+
+	for _, tc := range cases {
+		err := checkVolumeAttachmentPlatformDeviceName(tc.Name, "i-12345678", tc.Platform)
+		if tc.ExpectError != (err != nil) {
+			t.Fatalf("%s on %q: expected error %t, got %v", tc.Name, tc.Platform, tc.ExpectError, err)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_windowsDeviceName(t *testing.T) {
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeInstances":
+			out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+			out.Reservations[0].Instances[0].Platform = aws.String("windows")
+			*r.Data.(*ec2.DescribeInstancesOutput) = out
+		case "DescribeVolumes":
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "detached")
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	err := resourceAwsVolumeAttachmentCreate(d, client)
+	if err == nil || !strings.Contains(err.Error(), "runs Windows") {
+		t.Fatalf("expected a Windows device name error, got %v", err)
+	}
+	if !reflect.DeepEqual(*calls, []string{"DescribeVolumes", "DescribeInstances"}) {
+		t.Fatalf("expected the volume not to be attached, got %v", *calls)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_forceDetachElsewhere(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Name        string
+		ForceDetach bool
+		MultiAttach bool
+		VolumeType  string
+		OtherState  string
+		Expected    []string
+	}{
+		{
+			Name: "without force_detach",
+		},
+		{
+			Name:        "wedged on another instance",
+			ForceDetach: true,
+			Expected: []string{
+				"DescribeVolumes", "DescribeInstances", "AttachVolume", "DescribeVolumes", "DetachVolume",
+				"DescribeVolumes", "DescribeVolumes", "AttachVolume", "DescribeVolumes", "DescribeVolumes",
+				"DescribeVolumes", "DescribeInstances",
+			},
+		},
+		{
+			// A healthy Multi-Attach peer is never detached
+			Name:        "Multi-Attach peer",
+			ForceDetach: true,
+			MultiAttach: true,
+			Expected: []string{
+				"DescribeVolumes", "DescribeInstances", "AttachVolume", "DescribeVolumes",
+				"DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+			},
+		},
+		{
+			// An io2 volume may have Multi-Attach enabled, so a peer that
+			// attached cleanly is left alone even though AttachVolume keeps
+			// failing
+			Name:        "attached io2 peer",
+			ForceDetach: true,
+			VolumeType:  "io2",
+		},
+		{
+			Name:        "io2 wedged attaching on another instance",
+			ForceDetach: true,
+			VolumeType:  "io2",
+			OtherState:  "attaching",
+			Expected: []string{
+				"DescribeVolumes", "DescribeInstances", "AttachVolume", "DescribeVolumes", "DetachVolume",
+				"DescribeVolumes", "DescribeVolumes", "AttachVolume", "DescribeVolumes", "DescribeVolumes",
+				"DescribeVolumes", "DescribeInstances",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		detachedElsewhere := false
+		attached := false
+		client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeVolumes":
+				var others []string
+				if !detachedElsewhere {
+					others = append(others, "i-87654321")
+				}
+				state := "detached"
+				if attached {
+					state = "attached"
+				}
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", state, others...)
+				if tc.VolumeType != "" {
+					out.Volumes[0].VolumeType = aws.String(tc.VolumeType)
+				}
+				if tc.OtherState != "" && len(others) > 0 {
+					out.Volumes[0].Attachments[len(out.Volumes[0].Attachments)-1].State = aws.String(tc.OtherState)
+				}
+				// Mimic the attachment.instance-id filter
+				if f := r.Params.(*ec2.DescribeVolumesInput).Filters; f != nil && *f[0].Values[0] == "i-87654321" && detachedElsewhere {
+					out = ec2.DescribeVolumesOutput{}
+				}
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "DetachVolume":
+				params := r.Params.(*ec2.DetachVolumeInput)
+				if *params.InstanceId != "i-87654321" || !*params.Force {
+					t.Fatalf("%s: unexpected DetachVolume: %s", tc.Name, params)
+				}
+				detachedElsewhere = true
+			case "AttachVolume":
+				if !detachedElsewhere && !tc.MultiAttach {
+					r.Error = awserr.New("VolumeInUse", "vol-12345678 is attached to i-87654321", nil)
+					return
+				}
+				attached = true
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		d.Set("force_detach", tc.ForceDetach)
+		if tc.Expected == nil {
+			d.Set("timeouts", []interface{}{map[string]interface{}{"create": "10ms"}})
+		}
+		err := resourceAwsVolumeAttachmentCreate(d, client)
+		if tc.Expected == nil {
+			if err == nil {
+				t.Fatalf("%s: expected error", tc.Name)
+			}
+			if detachedElsewhere {
+				t.Fatalf("%s: expected the volume not to be detached from the other instance", tc.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Name, err)
+		}
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+
+		if !reflect.DeepEqual(*calls, tc.Expected) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.Name, tc.Expected, *calls)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_staleAttachment(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	// The volume is available but still lists a stale attachment to the
+	// instance, so AWS refuses to attach it again until that is cleared
+	cleared := false
+	attached := false
+	client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			state := "detached"
+			if attached {
+				state = "attached"
+			} else if !cleared {
+				state = "detaching"
+			}
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", state)
+			if !attached {
+				out.Volumes[0].State = aws.String("available")
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		case "DetachVolume":
+			params := r.Params.(*ec2.DetachVolumeInput)
+			if *params.InstanceId != "i-12345678" || !*params.Force {
+				t.Fatalf("unexpected DetachVolume: %s", params)
+			}
+			cleared = true
+		case "AttachVolume":
+			if !cleared {
+				r.Error = awserr.New("VolumeInUse", "vol-12345678 is already attached to an instance", nil)
+				return
+			}
+			attached = true
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	d.Set("force_detach", true)
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+
+	if !cleared || !attached {
+		t.Fatalf("expected the stale attachment to be cleared and the volume attached, got cleared %t, attached %t",
+			cleared, attached)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentCreate_replacedInstance(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	// The volume is still attached to an instance that has been replaced,
+	// which DescribeVolumes only shows once AttachVolume has failed
+	ghostVisible := false
+	detachedGhost := false
+	attached := false
+	client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			var others []string
+			if ghostVisible && !detachedGhost {
+				others = append(others, "i-87654321")
+			}
+			state := "detached"
+			if attached {
+				state = "attached"
+			}
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", state, others...)
+			if f := r.Params.(*ec2.DescribeVolumesInput).Filters; f != nil && *f[0].Values[0] == "i-87654321" && detachedGhost {
+				out = ec2.DescribeVolumesOutput{}
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		case "DetachVolume":
+			params := r.Params.(*ec2.DetachVolumeInput)
+			if *params.InstanceId != "i-87654321" || !*params.Force {
+				t.Fatalf("unexpected DetachVolume: %s", params)
+			}
+			detachedGhost = true
+		case "AttachVolume":
+			if !detachedGhost {
+				ghostVisible = true
+				r.Error = awserr.New("VolumeInUse", "vol-12345678 is already attached to an instance", nil)
+				return
+			}
+			attached = true
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	d.Set("force_detach", true)
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+
+	if !detachedGhost || !attached {
+		t.Fatalf("expected the volume to be detached from the replaced instance and attached, got detached %t, attached %t",
+			detachedGhost, attached)
+	}
+}
+
+func TestVolumeAttachmentInstanceIDByName_notUnique(t *testing.T) {
+	for _, ids := range [][]string{{}, {"i-12345678", "i-87654321"}} {
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			out := &ec2.Reservation{}
+			for _, id := range ids {
+				out.Instances = append(out.Instances, &ec2.Instance{InstanceId: aws.String(id)})
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{out},
+			}
+		})
+
+		_, err := volumeAttachmentInstanceIDByName(newInstrumentedEC2Conn(&AWSClient{ec2conn: conn}), "web")
+		if err == nil {
+			t.Fatalf("expected error for %d matching instances", len(ids))
+		}
+	}
+}
+
+func TestVolumeAttachmentVolumeIDByName_notUnique(t *testing.T) {
+	for _, ids := range [][]string{{}, {"vol-12345678", "vol-87654321"}} {
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			out := ec2.DescribeVolumesOutput{}
+			for _, id := range ids {
+				out.Volumes = append(out.Volumes, &ec2.Volume{VolumeId: aws.String(id)})
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		})
+
+		_, err := volumeAttachmentVolumeIDByName(newInstrumentedEC2Conn(&AWSClient{ec2conn: conn}), "data")
+		if err == nil {
+			t.Fatalf("expected error for %d matching volumes", len(ids))
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_detachTimeoutBehavior(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	for _, behavior := range []string{"error", "continue"} {
+		conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+			if r.Operation.Name == "DescribeVolumes" {
+				// The detach never completes
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", "detaching")
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.Set("stop_instance_before_detaching", false)
+		d.Set("detach_timeout_behavior", behavior)
+		d.Set("timeouts", []interface{}{map[string]interface{}{"delete": "10ms"}})
+
+		err := resourceAwsVolumeAttachmentDelete(d, &AWSClient{ec2conn: conn})
+		if behavior == "error" {
+			// The error names the instance and says why the wait failed
+			if err == nil || !strings.Contains(err.Error(), "Instance (i-12345678)") ||
+				!strings.Contains(err.Error(), "timeout") {
+				t.Fatalf("%s: expected a timeout error naming the instance, got %v", behavior, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", behavior, err)
+		}
+		if d.Id() != "" {
+			t.Fatalf("%s: expected ID to be cleared, got %q", behavior, d.Id())
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_detachTimeoutBehaviorNoStop(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	detaching := false
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			// The detach never completes
+			state := "attached"
+			if detaching {
+				state = "detaching"
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", state)
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "running")
+		case "DetachVolume":
+			detaching = true
+		}
+	})
+
+	// "continue" never stops the instance, even when asked to
+	d := testVolumeAttachmentResourceData()
+	d.Set("detach_timeout_behavior", "continue")
+	d.Set("timeouts", []interface{}{map[string]interface{}{"delete": "10ms"}})
+	for _, call := range volumeAttachmentPlannedCalls(d, true) {
+		if strings.HasPrefix(call, "StopInstances") {
+			t.Fatalf("expected no StopInstances to be planned, got %v", volumeAttachmentPlannedCalls(d, true))
+		}
+	}
+
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, call := range *calls {
+		if call == "StopInstances" || call == "StartInstances" {
+			t.Fatalf("expected the instance not to be stopped or started, got calls %v", *calls)
+		}
+	}
+	if !detaching || d.Id() != "" {
+		t.Fatalf("expected the volume to be detached and the ID cleared, got calls %v", *calls)
+	}
+}
+
+func TestResourceAwsVolumeAttachment_dryRun(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "attached")
+		case "AttachVolume":
+			if !*r.Params.(*ec2.AttachVolumeInput).DryRun {
+				t.Fatalf("expected AttachVolume to be a dry run")
+			}
+			r.Error = awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+		case "DetachVolume":
+			if !*r.Params.(*ec2.DetachVolumeInput).DryRun {
+				t.Fatalf("expected DetachVolume to be a dry run")
+			}
+			r.Error = awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+		}
+	})
+
+	// Nothing is attached, so nothing is recorded in state
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	d.Set("dry_run", true)
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Id() != "" {
+		t.Fatalf("expected no ID to be set, got %q", d.Id())
+	}
+
+	// Destroy neither stops the instance nor waits for a detach, and fails
+	// so that the attachment, which still exists, stays in state
+	d.SetId(volumeAttachmentID("/dev/sdh", "vol-12345678", "i-12345678"))
+	err := resourceAwsVolumeAttachmentDelete(d, client)
+	if err == nil || !strings.Contains(err.Error(), "nothing was detached") {
+		t.Fatalf("expected a dry run error, got %v", err)
+	}
+	if d.Id() == "" {
+		t.Fatalf("expected ID to be kept")
+	}
+
+	expected := []string{"DescribeInstances", "AttachVolume", "DescribeVolumes", "DetachVolume"}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_dryRunUnauthorized(t *testing.T) {
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "attached")
+		case "DetachVolume":
+			r.Error = awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("dry_run", true)
+	if err := resourceAwsVolumeAttachmentDelete(d, &AWSClient{ec2conn: conn}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if d.Id() == "" {
+		t.Fatalf("expected ID to be kept")
+	}
+}
+
+func TestResourceAwsVolumeAttachment_deleteOnTermination(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		Name string
+		// Set is the configured value, if any. The volume starts out with
+		// the opposite value, or with true when nothing is configured.
+		Set      interface{}
+		Expected bool
+	}{
+		{Name: "true", Set: true, Expected: true},
+		{Name: "false", Set: false, Expected: false},
+		{Name: "unset", Expected: true},
+	}
+
+	for _, tc := range cases {
+		deleteOnTermination := true
+		if v, ok := tc.Set.(bool); ok {
+			deleteOnTermination = !v
+		}
+		attached := false
+		client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "AttachVolume":
+				attached = true
+			case "DescribeVolumes":
+				if !attached {
+					*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+						"vol-12345678", "i-12345678", "detached")
+					return
+				}
+				out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "attached")
+				out.Volumes[0].Attachments[0].DeleteOnTermination = aws.Bool(deleteOnTermination)
+				*r.Data.(*ec2.DescribeVolumesOutput) = out
+			case "ModifyInstanceAttribute":
+				bdm := r.Params.(*ec2.ModifyInstanceAttributeInput).BlockDeviceMappings[0]
+				if *bdm.DeviceName != "/dev/sdh" || *bdm.Ebs.VolumeId != "vol-12345678" {
+					t.Fatalf("%s: unexpected block device mapping: %s", tc.Name, bdm)
+				}
+				deleteOnTermination = *bdm.Ebs.DeleteOnTermination
+			}
+		})
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		if tc.Set != nil {
+			d.Set("delete_on_termination", tc.Set)
+		}
+		if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tc.Name, err)
+		}
+		volumeAttachmentDevices.release("i-12345678", "/dev/sdh", "vol-12345678")
+
+		expected := []string{
+			"DescribeVolumes", "DescribeInstances", "AttachVolume", "DescribeVolumes", "DescribeVolumes",
+			"ModifyInstanceAttribute", "DescribeVolumes", "DescribeInstances",
+		}
+		if tc.Set == nil {
+			expected = []string{
+				"DescribeVolumes", "DescribeInstances", "AttachVolume", "DescribeVolumes", "DescribeVolumes",
+				"DescribeVolumes", "DescribeInstances",
+			}
+		}
+		if !reflect.DeepEqual(*calls, expected) {
+			t.Fatalf("%s: expected calls %v, got %v", tc.Name, expected, *calls)
+		}
+		if d.Get("delete_on_termination").(bool) != tc.Expected {
+			t.Fatalf("%s: expected delete_on_termination to be read back as %t", tc.Name, tc.Expected)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachment_batch(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	devices := map[string]string{"vol-11111111": "/dev/sdf", "vol-22222222": "/dev/sdg"}
+	attached := map[string]bool{}
+	instanceState := "running"
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			ids := aws.StringValueSlice(r.Params.(*ec2.DescribeVolumesInput).VolumeIds)
+			if len(ids) == 0 {
+				ids = []string{"vol-11111111", "vol-22222222"}
+			}
+			filtered := len(r.Params.(*ec2.DescribeVolumesInput).Filters) > 0
+			out := ec2.DescribeVolumesOutput{}
+			for _, id := range ids {
+				if attached[id] {
+					v := testVolumeAttachmentDescribeVolumesOutput(id, "i-12345678", "attached")
+					v.Volumes[0].Attachments[0].Device = aws.String(devices[id])
+					out.Volumes = append(out.Volumes, v.Volumes...)
+				} else if !filtered {
+					v := testVolumeAttachmentDescribeVolumesOutput(id, "", "detached")
+					out.Volumes = append(out.Volumes, v.Volumes...)
+				}
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", instanceState)
+		case "AttachVolume":
+			attached[*r.Params.(*ec2.AttachVolumeInput).VolumeId] = true
+		case "DetachVolume":
+			attached[*r.Params.(*ec2.DetachVolumeInput).VolumeId] = false
+		case "StopInstances":
+			instanceState = "stopped"
+		case "StartInstances":
+			instanceState = "running"
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.Set("instance_id", "i-12345678")
+	d.Set("stop_instance_before_detaching", true)
+	d.Set("wait_for_instance_running", true)
+	d.Set("manage_instance_power", true)
+	d.Set("attachments", []interface{}{
+		map[string]interface{}{"device_name": "/dev/sdf", "volume_id": "vol-11111111"},
+		map[string]interface{}{"device_name": "/dev/sdg", "volume_id": "vol-22222222"},
+	})
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Each volume is checked and attached in turn, and then both are waited on
+	expected := []string{
+		"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume",
+		"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume",
+		"DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeVolumes",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected create calls %v, got %v", expected, *calls)
+	}
+	if d.Id() == "" || d.Get("attachments").(*schema.Set).Len() != 2 {
+		t.Fatalf("expected both volumes to be attached, got %q %v", d.Id(), d.Get("attachments"))
+	}
+
+	*calls = nil
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The instance is only stopped once for both volumes
+	expected = []string{
+		"DescribeInstances", "DescribeInstances", "DescribeAutoScalingInstances", "StopInstances", "DescribeInstances",
+		"DetachVolume", "DetachVolume", "DescribeVolumes", "DescribeVolumes",
+		"StartInstances", "DescribeInstances",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected delete calls %v, got %v", expected, *calls)
+	}
+	if d.Id() != "" || attached["vol-11111111"] || attached["vol-22222222"] {
+		t.Fatalf("expected both volumes to be detached, got %q %v", d.Id(), attached)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_batchWaitErrors(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	// Neither volume detaches
+	states := map[string]string{"vol-11111111": "attached", "vol-22222222": "attaching"}
+	devices := map[string]string{"vol-11111111": "/dev/sdf", "vol-22222222": "/dev/sdg"}
+	client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+		if r.Operation.Name == "DescribeVolumes" {
+			id := *r.Params.(*ec2.DescribeVolumesInput).VolumeIds[0]
+			out := testVolumeAttachmentDescribeVolumesOutput(id, "i-12345678", states[id])
+			out.Volumes[0].Attachments[0].Device = aws.String(devices[id])
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.SetId("vai-1")
+	d.Set("instance_id", "i-12345678")
+	d.Set("attachments", []interface{}{
+		map[string]interface{}{"device_name": "/dev/sdf", "volume_id": "vol-11111111"},
+		map[string]interface{}{"device_name": "/dev/sdg", "volume_id": "vol-22222222"},
+	})
+	err := resourceAwsVolumeAttachmentDelete(d, client)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, expected := range []string{"/dev/sdf (vol-11111111) is attached", "/dev/sdg (vol-22222222) is attaching"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected the error to contain %q, got %q", expected, err)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentRead_batchDetached(t *testing.T) {
+	conn, _ := testVolumeAttachmentEC2Conn(func(r *request.Request) {
+		// Only one of the volumes is still attached
+		out := testVolumeAttachmentDescribeVolumesOutput("vol-22222222", "i-12345678", "attached")
+		out.Volumes[0].Attachments[0].Device = aws.String("/dev/sdg")
+		*r.Data.(*ec2.DescribeVolumesOutput) = out
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.SetId("vai-1")
+	d.Set("instance_id", "i-12345678")
+	d.Set("attachments", []interface{}{
+		map[string]interface{}{"device_name": "/dev/sdf", "volume_id": "vol-11111111"},
+		map[string]interface{}{"device_name": "/dev/sdg", "volume_id": "vol-22222222"},
+	})
+	// Read the attachments from state, as Terraform does, so that setting
+	// the smaller set replaces them
+	d = resourceAwsVolumeAttachment().Data(d.State())
+	if err := resourceAwsVolumeAttachmentRead(d, &AWSClient{ec2conn: conn}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	attachments := d.Get("attachments").(*schema.Set).List()
+	if len(attachments) != 1 || attachments[0].(map[string]interface{})["volume_id"] != "vol-22222222" {
+		t.Fatalf("expected only vol-22222222 to remain, got %v", attachments)
+	}
+}
+
+func TestResourceAwsVolumeAttachment_batchDryRun(t *testing.T) {
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "running")
+		case "DescribeVolumes":
+			id := *r.Params.(*ec2.DescribeVolumesInput).VolumeIds[0]
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(id, "", "detached")
+		case "AttachVolume":
+			if !*r.Params.(*ec2.AttachVolumeInput).DryRun {
+				t.Fatalf("expected AttachVolume to be a dry run")
+			}
+			r.Error = awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+		case "DetachVolume":
+			if !*r.Params.(*ec2.DetachVolumeInput).DryRun {
+				t.Fatalf("expected DetachVolume to be a dry run")
+			}
+			r.Error = awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+		default:
+			t.Fatalf("unexpected call to %s during a dry run", r.Operation.Name)
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.Set("instance_id", "i-12345678")
+	d.Set("stop_instance_before_detaching", true)
+	d.Set("manage_instance_power", true)
+	d.Set("dry_run", true)
+	d.Set("attachments", []interface{}{
+		map[string]interface{}{"device_name": "/dev/sdf", "volume_id": "vol-11111111"},
+		map[string]interface{}{"device_name": "/dev/sdg", "volume_id": "vol-22222222"},
+	})
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Id() != "" {
+		t.Fatalf("expected no ID to be set, got %q", d.Id())
+	}
+
+	d.SetId("vai-1")
+	err := resourceAwsVolumeAttachmentDelete(d, client)
+	if err == nil || !strings.Contains(err.Error(), "nothing was detached") {
+		t.Fatalf("expected a dry run error, got %v", err)
+	}
+	if d.Id() == "" {
+		t.Fatalf("expected ID to be kept")
+	}
+
+	// Each volume gets the same checks as a single attachment before its dry run
+	expected := []string{
+		"DescribeInstances", "DescribeVolumes", "AttachVolume",
+		"DescribeInstances", "DescribeVolumes", "AttachVolume",
+		"DescribeInstances", "DetachVolume", "DetachVolume",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_batchRootDevice(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	for _, allowRootDetach := range []bool{false, true} {
+		detached := false
+		client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+			switch r.Operation.Name {
+			case "DescribeInstances":
+				out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+				out.Reservations[0].Instances[0].RootDeviceName = aws.String("/dev/xvdf")
+				*r.Data.(*ec2.DescribeInstancesOutput) = out
+			case "DetachVolume":
+				detached = true
+			}
+		})
+
+		d := resourceAwsVolumeAttachment().TestResourceData()
+		d.SetId("vai-1")
+		d.Set("instance_id", "i-12345678")
+		d.Set("allow_root_detach", allowRootDetach)
+		d.Set("attachments", []interface{}{
+			map[string]interface{}{"device_name": "/dev/sdf", "volume_id": "vol-11111111"},
+			map[string]interface{}{"device_name": "/dev/sdg", "volume_id": "vol-22222222"},
+		})
+		err := resourceAwsVolumeAttachmentDelete(d, client)
+		if !allowRootDetach {
+			if err == nil || detached {
+				t.Fatalf("expected the root device not to be detached, got calls %v", *calls)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("allow_root_detach = true: unexpected error: %s", err)
+		}
+		if !detached {
+			t.Fatalf("expected the root device to be detached, got calls %v", *calls)
+		}
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_batchDetachRetry(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	// vol-11111111 is still in use the first time, and vol-22222222 has
+	// already been detached by someone else
+	inUse := true
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "running")
+		case "DescribeVolumes":
+			id := *r.Params.(*ec2.DescribeVolumesInput).VolumeIds[0]
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(id, "i-12345678", "detached")
+		case "DetachVolume":
+			switch *r.Params.(*ec2.DetachVolumeInput).VolumeId {
+			case "vol-11111111":
+				if inUse {
+					inUse = false
+					r.Error = awserr.New("VolumeInUse", "vol-11111111 is busy", nil)
+				}
+			case "vol-22222222":
+				r.Error = awserr.New("InvalidAttachment.NotFound", "vol-22222222 is not attached", nil)
+			}
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.SetId("vai-1")
+	d.Set("instance_id", "i-12345678")
+	// The instance isn't the resource's to stop, whatever
+	// stop_instance_before_detaching says
+	d.Set("stop_instance_before_detaching", true)
+	d.Set("manage_instance_power", false)
+	d.Set("attachments", []interface{}{
+		map[string]interface{}{"device_name": "/dev/sdf", "volume_id": "vol-11111111"},
+		map[string]interface{}{"device_name": "/dev/sdg", "volume_id": "vol-22222222"},
+	})
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"DescribeInstances", "DetachVolume", "DetachVolume", "DetachVolume", "DescribeVolumes", "DescribeVolumes",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if d.Id() != "" {
+		t.Fatalf("expected ID to be cleared, got %q", d.Id())
+	}
+}
+
+func TestResourceAwsVolumeAttachment_batchDeviceInUse(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	// /dev/sdg is already taken by another volume
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeInstances":
+			out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "running")
+			out.Reservations[0].Instances[0].BlockDeviceMappings = []*ec2.InstanceBlockDeviceMapping{
+				{
+					DeviceName: aws.String("/dev/sdg"),
+					Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-99999999")},
+				},
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = out
+		case "DescribeVolumes":
+			id := *r.Params.(*ec2.DescribeVolumesInput).VolumeIds[0]
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(id, "", "detached")
+		}
+	})
+
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.SetId("vai-1")
+	d.Set("instance_id", "i-12345678")
+	d.Set("attachments", []interface{}{
+		map[string]interface{}{"device_name": "/dev/sdf", "volume_id": "vol-11111111"},
+		map[string]interface{}{"device_name": "/dev/sdg", "volume_id": "vol-22222222"},
+	})
+	// Read the attachments from state, so that recording the smaller set
+	// replaces them
+	d = resourceAwsVolumeAttachment().Data(d.State())
+	d.SetId("")
+	err := resourceAwsVolumeAttachmentCreate(d, client)
+	defer volumeAttachmentDevices.release("i-12345678", "/dev/sdf", "vol-11111111")
+	if err == nil || !strings.Contains(err.Error(), "already in use by volume vol-99999999") {
+		t.Fatalf("expected a device in use error, got %v", err)
+	}
+
+	// The volume attached before the failure is kept in state, so that
+	// destroy detaches it
+	attachments := d.Get("attachments").(*schema.Set).List()
+	if d.Id() == "" || len(attachments) != 1 || attachments[0].(map[string]interface{})["volume_id"] != "vol-11111111" {
+		t.Fatalf("expected only vol-11111111 to be recorded, got %q %v", d.Id(), attachments)
+	}
+	for _, call := range *calls {
+		if call == "AttachVolume" {
+			return
+		}
+	}
+	t.Fatalf("expected vol-11111111 to be attached, got calls %v", *calls)
+}
+
+func TestResourceAwsVolumeAttachment_tags(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	attached := false
+	// The Name tag is managed by the volume's own resource
+	volumeTags := map[string]string{"Name": "data"}
+	var removed []*ec2.Tag
+	client, _ := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "AttachVolume":
+			attached = true
+		case "DetachVolume":
+			attached = false
+		case "CreateTags":
+			params := r.Params.(*ec2.CreateTagsInput)
+			if *params.Resources[0] != "vol-12345678" {
+				t.Fatalf("expected the volume to be tagged, got %s", *params.Resources[0])
+			}
+			for _, tag := range params.Tags {
+				volumeTags[*tag.Key] = *tag.Value
+			}
+		case "DeleteTags":
+			removed = r.Params.(*ec2.DeleteTagsInput).Tags
+		case "DescribeVolumes":
+			state := "detached"
+			if attached {
+				state = "attached"
+			}
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", state)
+			for k, v := range volumeTags {
+				out.Volumes[0].Tags = append(out.Volumes[0].Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.SetId("")
+	d.Set("stop_instance_before_detaching", false)
+	d.Set("tags", map[string]interface{}{"Role": "db"})
+	if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if volumeTags["Role"] != "db" {
+		t.Fatalf("expected the volume to be tagged with Role, got %v", volumeTags)
+	}
+	expected := map[string]interface{}{"Role": "db"}
+	if tags := d.Get("tags").(map[string]interface{}); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected only the attachment's tags to be read, got %v", tags)
+	}
+
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(removed) != 1 || *removed[0].Key != "Role" || *removed[0].Value != "db" {
+		t.Fatalf("expected only the Role tag to be removed, got %s", removed)
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_waitForAttachmentCleanup(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	detached := false
+	lingering := 2
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			if !detached {
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", "attached")
+				return
+			}
+			if lingering == 0 {
+				*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+					"vol-12345678", "i-12345678", "detached")
+				return
+			}
+			// The attachment reports detached but its record hasn't gone yet
+			lingering--
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", "detached", "i-12345678")
+			r.Data.(*ec2.DescribeVolumesOutput).Volumes[0].Attachments[0].State = aws.String("detached")
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "stopped")
+		case "DetachVolume":
+			detached = true
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("wait_for_attachment_cleanup", true)
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"DescribeVolumes", "DescribeInstances", "DetachVolume",
+		"DescribeVolumes", "DescribeVolumes", "DescribeVolumes",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if lingering != 0 {
+		t.Fatalf("expected Delete to wait out the lingering attachment record")
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_waitForDeviceRelease(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	detached := false
+	mapped := 2
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			state := "attached"
+			if detached {
+				state = "detached"
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", state)
+		case "DescribeInstances":
+			out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", "stopped")
+			if !detached || mapped > 0 {
+				// The mappings lag behind the detach
+				if detached {
+					mapped--
+				}
+				out.Reservations[0].Instances[0].BlockDeviceMappings = []*ec2.InstanceBlockDeviceMapping{
+					{
+						DeviceName: aws.String("/dev/xvdh"),
+						Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-12345678")},
+					},
+				}
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = out
+		case "DetachVolume":
+			detached = true
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("wait_for_device_release", true)
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"DescribeVolumes", "DescribeInstances", "DetachVolume", "DescribeVolumes",
+		"DescribeInstances", "DescribeInstances", "DescribeInstances",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if mapped != 0 {
+		t.Fatalf("expected Delete to wait for the device to be released")
+	}
+}
+
+func TestResourceAwsVolumeAttachmentDelete_waitForAvailable(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	detached := false
+	inUse := 2
+	client, calls := testVolumeAttachmentClient(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeVolumes":
+			state := "attached"
+			if detached {
+				state = "detached"
+			}
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", state)
+			if detached && inUse > 0 {
+				// The volume state lags behind the detach
+				inUse--
+				out.Volumes[0].State = aws.String("in-use")
+			}
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		case "DescribeInstances":
+			*r.Data.(*ec2.DescribeInstancesOutput) = testVolumeAttachmentDescribeInstancesOutput(
+				"i-12345678", "stopped")
+		case "DetachVolume":
+			detached = true
+		}
+	})
+
+	d := testVolumeAttachmentResourceData()
+	d.Set("wait_for_available", true)
+	if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"DescribeVolumes", "DescribeInstances", "DetachVolume", "DescribeVolumes",
+		"DescribeVolumes", "DescribeVolumes",
+	}
+	if !reflect.DeepEqual(*calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, *calls)
+	}
+	if inUse != 0 {
+		t.Fatalf("expected Delete to wait for the volume to become available")
+	}
+}
+
+// TestResourceAwsVolumeAttachment_lifecycle runs an attachment through Create
+// and Delete against a fake EC2 that tracks the volume and instance state, to
+// check the order of the calls made on each path.
+func TestResourceAwsVolumeAttachment_lifecycle(t *testing.T) {
+	defer testVolumeAttachmentNoWaitDelay()()
+
+	cases := []struct {
+		StopInstance bool
+		ForceDetach  bool
+		ExpectDelete []string
+	}{
+		{
+			StopInstance: true,
+			ForceDetach:  false,
+			ExpectDelete: []string{
+				"DescribeVolumes", "DescribeInstances", "DescribeAutoScalingInstances", "StopInstances",
+				"DescribeInstances", "DetachVolume", "DescribeVolumes", "StartInstances", "DescribeInstances",
+			},
+		},
+		{
+			StopInstance: false,
+			ForceDetach:  true,
+			ExpectDelete: []string{"DescribeVolumes", "DetachVolume", "DescribeVolumes"},
+		},
+	}
+
+	for _, tc := range cases {
+		fake := testVolumeAttachmentFake{Volume: "detached"}
+		client, calls := fake.client()
+
+		d := testVolumeAttachmentResourceData()
+		d.SetId("")
+		d.Set("stop_instance_before_detaching", tc.StopInstance)
+		d.Set("force_detach", tc.ForceDetach)
+		if err := resourceAwsVolumeAttachmentCreate(d, client); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := []string{
+			"DescribeVolumes", "DescribeInstances", "DescribeVolumes", "AttachVolume",
+			"DescribeVolumes", "DescribeVolumes", "DescribeVolumes", "DescribeInstances",
+		}
+		if tc.StopInstance {
+			expected = append(expected, "DescribeAutoScalingInstances")
+		}
+		if !reflect.DeepEqual(*calls, expected) {
+			t.Fatalf("create: expected calls %v, got %v", expected, *calls)
+		}
+
+		*calls = []string{}
+		if err := resourceAwsVolumeAttachmentDelete(d, client); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(*calls, tc.ExpectDelete) {
+			t.Fatalf("delete: expected calls %v, got %v", tc.ExpectDelete, *calls)
+		}
+		if !reflect.DeepEqual(fake.Forced, []bool{tc.ForceDetach}) {
+			t.Fatalf("expected DetachVolume Force to be %t, got %v", tc.ForceDetach, fake.Forced)
+		}
+		if fake.Instance != "running" {
+			t.Fatalf("expected the instance to be running again, got %q", fake.Instance)
+		}
+		if d.Id() != "" {
+			t.Fatalf("expected ID to be cleared, got %q", d.Id())
+		}
+	}
+}
+
+// testVolumeAttachmentFake is a fake EC2 for vol-12345678 and i-12345678
+// that tracks the attachment and instance state as the calls made against it
+// change them. The zero value is the volume attached to a running instance.
+type testVolumeAttachmentFake struct {
+	// Volume is the attachment state, "attached" unless set. "detached"
+	// leaves the volume available and "missing" reports no volume at all.
+	Volume string
+
+	// VolumeStates are reported by the first DescribeVolumes calls before
+	// Volume takes over. "creating" is an unattached volume still being
+	// created.
+	VolumeStates []string
+
+	// OtherInstanceIDs are further Multi-Attach attachments of the volume
+	OtherInstanceIDs []string
+
+	// DetachesTo is the state a DetachVolume without Force leaves the
+	// volume in, "detached" unless set
+	DetachesTo string
+
+	// DetachedByHand makes DetachVolume find the volume already detached
+	DetachedByHand bool
+
+	// Instance is the instance state, "running" unless set, and
+	// InstanceStates are reported by the first DescribeInstances calls
+	// before Instance takes over
+	Instance       string
+	InstanceStates []string
+
+	// StopsTo is the state StopInstances leaves the instance in, "stopped"
+	// unless set
+	StopsTo string
+
+	InstanceType string
+	Lifecycle    string
+
+	// AutoScaling puts the instance in the Auto Scaling group "web"
+	AutoScaling bool
+
+	// Errors fails successive calls to the named operations with the listed
+	// error codes and request ID req-1. A failed call changes nothing, and
+	// the calls after the listed ones succeed.
+	Errors map[string][]string
+
+	// Forced records the Force flag of each DetachVolume call
+	Forced []bool
+}
+
+// client returns an AWSClient whose EC2 and Auto Scaling calls are answered
+// by the fake, and the operation names called.
+func (f *testVolumeAttachmentFake) client() (*AWSClient, *[]string) {
+	if f.Volume == "" {
+		f.Volume = "attached"
+	}
+	if f.Instance == "" {
+		f.Instance = "running"
+	}
+	return testVolumeAttachmentClient(f.respond)
+}
+
+func (f *testVolumeAttachmentFake) respond(r *request.Request) {
+	if codes := f.Errors[r.Operation.Name]; len(codes) > 0 {
+		f.Errors[r.Operation.Name] = codes[1:]
+		r.Error = awserr.NewRequestFailure(
+			awserr.New(codes[0], r.Operation.Name+" failed", nil), 400, "req-1")
+		return
+	}
+
+	switch r.Operation.Name {
+	case "DescribeVolumes":
+		state := f.Volume
+		if len(f.VolumeStates) > 0 {
+			state, f.VolumeStates = f.VolumeStates[0], f.VolumeStates[1:]
+		}
+		switch state {
+		case "missing":
+		case "creating":
+			out := testVolumeAttachmentDescribeVolumesOutput("vol-12345678", "i-12345678", "detached")
+			out.Volumes[0].State = aws.String("creating")
+			*r.Data.(*ec2.DescribeVolumesOutput) = out
+		default:
+			*r.Data.(*ec2.DescribeVolumesOutput) = testVolumeAttachmentDescribeVolumesOutput(
+				"vol-12345678", "i-12345678", state, f.OtherInstanceIDs...)
+		}
+	case "DescribeInstances":
+		state := f.Instance
+		if len(f.InstanceStates) > 0 {
+			state, f.InstanceStates = f.InstanceStates[0], f.InstanceStates[1:]
+		}
+		out := testVolumeAttachmentDescribeInstancesOutput("i-12345678", state)
+		if f.InstanceType != "" {
+			out.Reservations[0].Instances[0].InstanceType = aws.String(f.InstanceType)
+		}
+		if f.Lifecycle != "" {
+			out.Reservations[0].Instances[0].InstanceLifecycle = aws.String(f.Lifecycle)
+		}
+		*r.Data.(*ec2.DescribeInstancesOutput) = out
+	case "DescribeAutoScalingInstances":
+		if f.AutoScaling {
+			*r.Data.(*autoscaling.DescribeAutoScalingInstancesOutput) = autoscaling.DescribeAutoScalingInstancesOutput{
+				AutoScalingInstances: []*autoscaling.InstanceDetails{
+					{
+						AutoScalingGroupName: aws.String("web"),
+						InstanceId:           aws.String("i-12345678"),
+						ProtectedFromScaleIn: aws.Bool(true),
+					},
+				},
+			}
+		}
+	case "AttachVolume":
+		f.Volume = "attached"
+	case "StopInstances":
+		f.Instance = "stopped"
+		if f.StopsTo != "" {
+			f.Instance = f.StopsTo
+		}
+	case "StartInstances":
+		f.Instance = "running"
+	case "DetachVolume":
+		force := aws.BoolValue(r.Params.(*ec2.DetachVolumeInput).Force)
+		f.Forced = append(f.Forced, force)
+		f.Volume = "detached"
+		if f.DetachedByHand {
+			r.Error = awserr.New("InvalidAttachment.NotFound",
+				"The volume vol-12345678 is not attached to instance i-12345678", nil)
+			return
+		}
+		if !force && f.DetachesTo != "" {
+			f.Volume = f.DetachesTo
+		}
+	}
+}
+
+// testVolumeAttachmentEC2Conn returns an EC2 client that never reaches AWS.
+// Every request is answered by respond, which fills in r.Data or sets
+// r.Error, and the operation names are recorded in the returned slice.
+func testVolumeAttachmentEC2Conn(respond func(r *request.Request)) (*ec2.EC2, *[]string) {
+	client, calls := testVolumeAttachmentClient(respond)
+	return client.ec2conn, calls
+}
+
+// testVolumeAttachmentClient is like testVolumeAttachmentEC2Conn, but returns
+// an AWSClient whose EC2 and Auto Scaling clients share respond.
+func testVolumeAttachmentClient(respond func(r *request.Request)) (*AWSClient, *[]string) {
+	calls := []string{}
+	sess := session.New(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	fake := func(h *request.Handlers) {
+		h.Clear()
+		h.Send.PushBack(func(r *request.Request) {
+			calls = append(calls, r.Operation.Name)
+			respond(r)
+		})
+	}
+
+	client := &AWSClient{
+		ec2conn:         ec2.New(sess),
+		autoscalingconn: autoscaling.New(sess),
+	}
+	fake(&client.ec2conn.Handlers)
+	fake(&client.autoscalingconn.Handlers)
+	return client, &calls
+}
+
+// testVolumeAttachmentNoWaitDelay removes the polling delays from the
+// attachment waiters, returning a func that restores them.
+func testVolumeAttachmentNoWaitDelay() func() {
+	delay, minTimeout := volumeAttachmentWaitDelay, volumeAttachmentWaitMinTimeout
+	volumeAttachmentWaitDelay, volumeAttachmentWaitMinTimeout = 0, 10*time.Millisecond
+	return func() {
+		volumeAttachmentWaitDelay, volumeAttachmentWaitMinTimeout = delay, minTimeout
+	}
+}
+
+func testVolumeAttachmentResourceData() *schema.ResourceData {
+	d := resourceAwsVolumeAttachment().TestResourceData()
+	d.SetId(volumeAttachmentID("/dev/sdh", "vol-12345678", "i-12345678"))
+	d.Set("device_name", "/dev/sdh")
+	d.Set("instance_id", "i-12345678")
+	d.Set("volume_id", "vol-12345678")
+	d.Set("stop_instance_before_detaching", true)
+	d.Set("wait_for_instance_running", true)
+	d.Set("manage_instance_power", true)
+	return d
+}
+
+func testVolumeAttachmentDescribeVolumesOutput(volumeID, instanceID, state string, otherInstanceIDs ...string) ec2.DescribeVolumesOutput {
+	v := &ec2.Volume{
+		VolumeId: aws.String(volumeID),
+		State:    aws.String("in-use"),
+	}
+	if state != "detached" {
+		v.Attachments = append(v.Attachments, &ec2.VolumeAttachment{
+			Device:     aws.String("/dev/sdh"),
+			InstanceId: aws.String(instanceID),
+			VolumeId:   aws.String(volumeID),
+			State:      aws.String(state),
+		})
+	}
+	for _, id := range otherInstanceIDs {
+		v.Attachments = append(v.Attachments, &ec2.VolumeAttachment{
+			Device:     aws.String("/dev/sdh"),
+			InstanceId: aws.String(id),
+			VolumeId:   aws.String(volumeID),
+			State:      aws.String("attached"),
+		})
+	}
+	if len(v.Attachments) == 0 {
+		v.State = aws.String("available")
+	}
+	return ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{v}}
+}
+
+func testVolumeAttachmentDescribeInstancesOutput(instanceID, state string) ec2.DescribeInstancesOutput {
+	return ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						InstanceId: aws.String(instanceID),
+						State:      &ec2.InstanceState{Name: aws.String(state)},
+					},
+				},
+			},
+		},
+	}
+}
+
 func testAccCheckVolumeAttachmentExists(n string, i *ec2.Instance, v *ec2.Volume) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
 		rs, ok := s.RootModule().Resources[n]
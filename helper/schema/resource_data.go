@@ -102,6 +102,17 @@ func (d *ResourceData) GetOk(key string) (interface{}, bool) {
 	return r.Value, exists
 }
 
+// GetOkExists returns the data for the given key and whether or not the key
+// has been set at some point, including to the zero value.
+//
+// Unlike GetOk, this tells a bool that was set to false apart from one that
+// wasn't set at all, which matters for Optional attributes without a Default.
+func (d *ResourceData) GetOkExists(key string) (interface{}, bool) {
+	r := d.getRaw(key, getSourceSet)
+	exists := r.Exists && !r.Computed
+	return r.Value, exists
+}
+
 func (d *ResourceData) getRaw(key string, level getSource) getResult {
 	var parts []string
 	if key != "" {
@@ -1080,6 +1080,126 @@ func TestResourceDataGetOk(t *testing.T) {
 	}
 }
 
+func TestResourceDataGetOkExists(t *testing.T) {
+	cases := []struct {
+		Schema map[string]*Schema
+		State  *terraform.InstanceState
+		Diff   *terraform.InstanceDiff
+		Key    string
+		Value  interface{}
+		Ok     bool
+	}{
+		// Set to false, which GetOk can't tell apart from unset
+		{
+			Schema: map[string]*Schema{
+				"enabled": &Schema{
+					Type:     TypeBool,
+					Optional: true,
+					Computed: true,
+				},
+			},
+
+			State: nil,
+
+			Diff: &terraform.InstanceDiff{
+				Attributes: map[string]*terraform.ResourceAttrDiff{
+					"enabled": &terraform.ResourceAttrDiff{
+						Old: "",
+						New: "false",
+					},
+				},
+			},
+
+			Key:   "enabled",
+			Value: false,
+			Ok:    true,
+		},
+
+		{
+			Schema: map[string]*Schema{
+				"enabled": &Schema{
+					Type:     TypeBool,
+					Optional: true,
+					Computed: true,
+				},
+			},
+
+			State: nil,
+
+			Diff: &terraform.InstanceDiff{
+				Attributes: map[string]*terraform.ResourceAttrDiff{
+					"enabled": &terraform.ResourceAttrDiff{
+						Old: "",
+						New: "true",
+					},
+				},
+			},
+
+			Key:   "enabled",
+			Value: true,
+			Ok:    true,
+		},
+
+		// Unset and left to be computed
+		{
+			Schema: map[string]*Schema{
+				"enabled": &Schema{
+					Type:     TypeBool,
+					Optional: true,
+					Computed: true,
+				},
+			},
+
+			State: nil,
+
+			Diff: &terraform.InstanceDiff{
+				Attributes: map[string]*terraform.ResourceAttrDiff{
+					"enabled": &terraform.ResourceAttrDiff{
+						Old:         "",
+						NewComputed: true,
+					},
+				},
+			},
+
+			Key:   "enabled",
+			Value: false,
+			Ok:    false,
+		},
+
+		{
+			Schema: map[string]*Schema{
+				"enabled": &Schema{
+					Type:     TypeBool,
+					Optional: true,
+				},
+			},
+
+			State: nil,
+
+			Diff: nil,
+
+			Key:   "enabled",
+			Value: false,
+			Ok:    false,
+		},
+	}
+
+	for i, tc := range cases {
+		d, err := schemaMap(tc.Schema).Data(tc.State, tc.Diff)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		v, ok := d.GetOkExists(tc.Key)
+		if !reflect.DeepEqual(v, tc.Value) {
+			t.Fatalf("Bad: %d\n\n%#v", i, v)
+		}
+		if ok != tc.Ok {
+			t.Fatalf("%d: expected ok: %t, got: %t", i, tc.Ok, ok)
+		}
+	}
+}
+
 func TestResourceDataHasChange(t *testing.T) {
 	cases := []struct {
 		Schema map[string]*Schema